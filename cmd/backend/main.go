@@ -4,25 +4,40 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	stdlog "log"
 	"net/http"
 	"os"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi"
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
+	"github.com/pkg/errors"
 	"github.com/povilasv/prommod"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/prometheus/promql"
+	promstorage "github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
 	"go.opentelemetry.io/otel/api/kv"
 	"go.opentelemetry.io/otel/exporters/trace/jaeger"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/kakkoyun/observable-remote-write/internal"
+	"github.com/kakkoyun/observable-remote-write/internal/api"
+	"github.com/kakkoyun/observable-remote-write/internal/cardinality"
 	internalhttp "github.com/kakkoyun/observable-remote-write/internal/http"
 	"github.com/kakkoyun/observable-remote-write/internal/http/middleware"
+	"github.com/kakkoyun/observable-remote-write/internal/limits"
+	"github.com/kakkoyun/observable-remote-write/internal/metadata"
+	"github.com/kakkoyun/observable-remote-write/internal/reader"
 	"github.com/kakkoyun/observable-remote-write/internal/receiver"
+	"github.com/kakkoyun/observable-remote-write/internal/storage"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
 )
 
 // gracePeriod specify graceful shutdown period.
@@ -31,12 +46,25 @@ const (
 	serviceName = "observable_remote_write_backend"
 )
 
+const (
+	storageLog     = "log"
+	storageDiscard = "discard"
+	storageTSDB    = "tsdb"
+)
+
+// defaultSubqueryInterval is the evaluation interval of subqueries that do not specify a step.
+const defaultSubqueryInterval = time.Minute
+
 type config struct {
 	logLevel  string
 	logFormat string
 
-	debug  debugConfig
-	server serverConfig
+	debug   debugConfig
+	server  serverConfig
+	storage storageConfig
+	query   queryConfig
+	read    readConfig
+	receive receiveConfig
 }
 
 type debugConfig struct {
@@ -49,6 +77,53 @@ type serverConfig struct {
 	listen         string
 	listenInternal string
 	healthcheckURL string
+
+	tenantHeader   string
+	defaultTenant  string
+	allowedTenants []string
+	maxTenants     int
+}
+
+type storageConfig struct {
+	kind string
+	tsdb tsdbConfig
+}
+
+type tsdbConfig struct {
+	path             string
+	retention        time.Duration
+	maxBytes         int64
+	minBlockDuration time.Duration
+	maxBlockDuration time.Duration
+	walCompression   bool
+	noLockfile       bool
+}
+
+type queryConfig struct {
+	timeout       time.Duration
+	maxSamples    int
+	lookbackDelta time.Duration
+}
+
+type readConfig struct {
+	sampleLimit      int
+	concurrencyLimit int
+	maxBytesInFrame  int
+}
+
+type receiveConfig struct {
+	orderPolicies      receiver.OrderPolicies
+	orderTTL           time.Duration
+	limitsFile         string
+	activeSeriesWindow time.Duration
+	haTracker          bool
+	ha                 receiver.HAOptions
+}
+
+// backendStorage is a storage that received samples are appended to and queries are evaluated over.
+type backendStorage interface {
+	receiver.Appender
+	promstorage.Queryable
 }
 
 func main() {
@@ -99,25 +174,82 @@ func main() {
 	logger := internal.NewLogger(cfg.logLevel, cfg.logFormat, cfg.debug.name)
 	defer level.Info(logger).Log("msg", "exiting")
 
+	// Initialize storage to hand received samples to.
+	db, err := newStorage(cfg.storage, logger, reg)
+	if err != nil {
+		level.Error(logger).Log("msg", "failed to initialize storage", "err", err)
+		os.Exit(1)
+	}
+
+	if c, ok := db.(io.Closer); ok {
+		defer internal.CloseWithLogOnErr(logger, c)
+	}
+
+	// Initialize PromQL engine to evaluate queries over the storage.
+	engine := promql.NewEngine(promql.EngineOpts{
+		Logger:        log.With(logger, "component", "query engine"),
+		Reg:           reg,
+		MaxSamples:    cfg.query.maxSamples,
+		Timeout:       cfg.query.timeout,
+		LookbackDelta: cfg.query.lookbackDelta,
+		NoStepSubqueryIntervalFn: func(int64) int64 {
+			return durationToMillis(defaultSubqueryInterval)
+		},
+	})
+
 	// Initialize run group.
 	g := &run.Group{}
 	{
+		admitter := tenancy.NewAdmitter(cfg.server.allowedTenants, cfg.server.maxTenants)
 		metrics := middleware.NewMetricsMiddleware(reg)
-		// Main server to listen for public APIs.
-		mux := http.NewServeMux()
-		mux.Handle("/receive",
-			metrics.NewHandler("receive")(
-				middleware.Tracer(logger, tracer, "receive-proxy")(
-					middleware.RequestID(
-						middleware.Logger(logger)(
-							// othttp.NewHandler(
-							receiver.Receive(logger, tracer),
+		instrument := func(name string, h http.Handler) http.Handler {
+			return middleware.Tenant(cfg.server.tenantHeader, cfg.server.defaultTenant, admitter)(
+				metrics.NewHandler(name)(
+					middleware.Tracer(logger, tracer, name)(
+						middleware.RequestID(
+							middleware.Logger(logger)(middleware.RejectTenant(h)),
 						),
-						// "receive-proxy", othttp.WithTracer(tracer),
 					),
 				),
-			),
-		)
+			)
+		}
+
+		// Main server to listen for public APIs.
+		mux := http.NewServeMux()
+		metadataStore := metadata.NewStore(db, log.With(logger, "component", "metadata"), reg)
+		tracker := cardinality.NewTracker(metadataStore, reg, cfg.receive.activeSeriesWindow)
+
+		var app receiver.Appender = receiver.NewOrderChecker(tracker, reg, cfg.receive.orderPolicies, cfg.receive.orderTTL)
+		if cfg.receive.limitsFile != "" {
+			lcfg, err := limits.Load(cfg.receive.limitsFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to load limits", "err", err)
+				os.Exit(1)
+			}
+
+			app = receiver.NewLimiter(app, reg, lcfg)
+		}
+
+		// Invalid series are dropped before they count against the limits of their tenant.
+		app = receiver.NewValidator(app, reg)
+
+		// Samples of standby replicas are dropped before they count against the limits of their tenant.
+		if cfg.receive.haTracker {
+			app = receiver.NewHATracker(app, log.With(logger, "component", "ha-tracker"), reg, cfg.receive.ha)
+		}
+
+		mux.Handle("/receive", instrument("receive", receiver.Receive(logger, tracer, reg, app)))
+		mux.Handle("/read", instrument("read", reader.Read(logger, tracer, db, reader.Options{
+			SampleLimit:      cfg.read.sampleLimit,
+			ConcurrencyLimit: cfg.read.concurrencyLimit,
+			MaxBytesInFrame:  cfg.read.maxBytesInFrame,
+		})))
+
+		router := chi.NewRouter()
+		router.Route("/api/v1", func(r chi.Router) {
+			api.New(log.With(logger, "component", "api"), engine, db, tracker, metadataStore).Register(r, instrument)
+		})
+		mux.Handle("/api/v1/", router)
 		srv := &http.Server{
 			Addr:    cfg.server.listen,
 			Handler: mux,
@@ -171,7 +303,13 @@ func main() {
 // Helpers
 
 func parseFlags() config {
-	cfg := config{}
+	var (
+		cfg                        = config{}
+		rawOutOfOrderPolicy        string
+		rawDuplicatePolicy         string
+		rawDuplicateDifferentValue string
+		rawAllowedTenants          string
+	)
 
 	flag.StringVar(&cfg.debug.name, "debug.name", "observable-remote-write-backend",
 		"A name to add as a prefix to log lines.")
@@ -189,7 +327,139 @@ func parseFlags() config {
 		"The address on which the internal server listens.")
 	flag.StringVar(&cfg.server.healthcheckURL, "web.healthchecks.url", "http://127.0.0.1:8080",
 		"The URL against which to run healthchecks.")
+	flag.StringVar(&cfg.server.tenantHeader, "web.tenant-header", tenancy.DefaultTenantHeader,
+		"The HTTP header to read the tenant of a request from.")
+	flag.StringVar(&cfg.server.defaultTenant, "web.default-tenant", tenancy.DefaultTenant,
+		"The tenant to attribute requests without a tenant header to.")
+	flag.StringVar(&rawAllowedTenants, "web.allowed-tenants", "",
+		"Comma-separated tenants to accept requests from, besides the default tenant. Any tenant is accepted if empty.")
+	flag.IntVar(&cfg.server.maxTenants, "web.max-tenants", 1000,
+		"The maximum number of distinct tenants to accept requests from, besides the default tenant. "+
+			"Requests of further tenants are rejected with 403. No limit applies if 0.")
+	flag.StringVar(&cfg.storage.kind, "storage.type", storageLog,
+		"The storage to hand received samples to. Options: 'log', 'discard', 'tsdb'.")
+	flag.StringVar(&cfg.storage.tsdb.path, "tsdb.path", "data/",
+		"The directory to store TSDB blocks and write-ahead log in, one subdirectory per tenant.")
+	flag.DurationVar(&cfg.storage.tsdb.retention, "tsdb.retention", 15*24*time.Hour,
+		"How long to retain samples in the TSDB.")
+	flag.Int64Var(&cfg.storage.tsdb.maxBytes, "tsdb.retention.size", 0,
+		"The maximum number of bytes of blocks to retain in the TSDB. 0 means disabled.")
+	flag.DurationVar(&cfg.storage.tsdb.minBlockDuration, "tsdb.min-block-duration", 2*time.Hour,
+		"The time range of the head block after which it gets compacted into a persisted block.")
+	flag.DurationVar(&cfg.storage.tsdb.maxBlockDuration, "tsdb.max-block-duration", 0,
+		"The maximum time range of compacted blocks. Defaults to 10% of the retention period.")
+	flag.BoolVar(&cfg.storage.tsdb.walCompression, "tsdb.wal-compression", false,
+		"Compress the TSDB write-ahead log using Snappy.")
+	flag.BoolVar(&cfg.storage.tsdb.noLockfile, "tsdb.no-lockfile", false,
+		"Do not create a lockfile in the TSDB directory.")
+	flag.DurationVar(&cfg.query.timeout, "query.timeout", 2*time.Minute,
+		"Maximum time a query may take before being aborted.")
+	flag.IntVar(&cfg.query.maxSamples, "query.max-samples", 50000000,
+		"Maximum number of samples a single query can load into memory.")
+	flag.DurationVar(&cfg.query.lookbackDelta, "query.lookback-delta", 5*time.Minute,
+		"The maximum lookback duration for retrieving metrics during expression evaluations.")
+	flag.IntVar(&cfg.read.sampleLimit, "read.sample-limit", 5e7,
+		"Maximum number of samples to return via the remote read interface, in a single query. 0 means no limit.")
+	flag.IntVar(&cfg.read.concurrencyLimit, "read.concurrent-limit", 10,
+		"Maximum number of concurrent remote read calls.")
+	flag.IntVar(&cfg.read.maxBytesInFrame, "read.max-bytes-in-frame", 1048576,
+		"Maximum number of bytes in a single frame for streaming remote read responses.")
+	flag.StringVar(&rawOutOfOrderPolicy, "receive.out-of-order-policy", string(receiver.PolicyReject),
+		"What to do with samples older than the last sample of their series. Options: 'reject', 'drop', 'accept'.")
+	flag.StringVar(&rawDuplicatePolicy, "receive.duplicate-policy", string(receiver.PolicyDrop),
+		"What to do with samples repeating the timestamp and value of the last sample of their series. Options: 'reject', 'drop', 'accept'.")
+	flag.StringVar(&rawDuplicateDifferentValue, "receive.duplicate-different-value-policy", string(receiver.PolicyReject),
+		"What to do with samples repeating the timestamp but not the value of the last sample of their series. Options: 'reject', 'drop', 'accept'.")
+	flag.DurationVar(&cfg.receive.orderTTL, "receive.order-tracking-ttl", time.Hour,
+		"How long to remember the last sample of a series that stopped receiving samples.")
+	flag.StringVar(&cfg.receive.limitsFile, "receive.limits-file", "",
+		"Path to a YAML file with default and per-tenant ingestion limits. No limits are enforced if empty.")
+	flag.DurationVar(&cfg.receive.activeSeriesWindow, "receive.active-series-window", 10*time.Minute,
+		"How long a series is considered active after its last sample, for cardinality statistics.")
+	flag.BoolVar(&cfg.receive.haTracker, "receive.ha-tracker", false,
+		"Deduplicate HA pairs of Prometheus servers by only accepting samples from one elected replica per cluster.")
+	flag.StringVar(&cfg.receive.ha.ClusterLabel, "receive.ha-cluster-label", "cluster",
+		"The label identifying the HA cluster of a series.")
+	flag.StringVar(&cfg.receive.ha.ReplicaLabel, "receive.ha-replica-label", "__replica__",
+		"The label identifying the replica of a series within its HA cluster. It is removed before storage.")
+	flag.DurationVar(&cfg.receive.ha.FailoverTimeout, "receive.ha-failover-timeout", 30*time.Second,
+		"The time without samples from the elected replica of a cluster after which another replica is elected.")
 	flag.Parse()
 
+	for _, tenant := range strings.Split(rawAllowedTenants, ",") {
+		if tenant == "" {
+			continue
+		}
+
+		if err := tenancy.Validate(tenant); err != nil {
+			stdlog.Fatalf("invalid allowed tenant; err: %v", err)
+		}
+
+		cfg.server.allowedTenants = append(cfg.server.allowedTenants, tenant)
+	}
+
+	if cfg.server.maxTenants < 0 {
+		stdlog.Fatalf("maximum number of tenants must not be negative")
+	}
+
+	for _, p := range []struct {
+		raw    string
+		policy *receiver.Policy
+	}{
+		{rawOutOfOrderPolicy, &cfg.receive.orderPolicies.OutOfOrder},
+		{rawDuplicatePolicy, &cfg.receive.orderPolicies.Duplicate},
+		{rawDuplicateDifferentValue, &cfg.receive.orderPolicies.DuplicateDifferentValue},
+	} {
+		policy, err := receiver.ParsePolicy(p.raw)
+		if err != nil {
+			stdlog.Fatalf("failed to parse policy %v; err: %v", p.raw, err)
+		}
+
+		*p.policy = policy
+	}
+
 	return cfg
 }
+
+func newStorage(cfg storageConfig, logger log.Logger, reg prometheus.Registerer) (backendStorage, error) {
+	switch cfg.kind {
+	case storageLog:
+		return storage.NewLogAppender(logger), nil
+	case storageDiscard:
+		return storage.NewDiscardAppender(), nil
+	case storageTSDB:
+		return storage.NewMultiTSDB(cfg.tsdb.path, logger, reg, tsdbOptions(cfg.tsdb))
+	default:
+		return nil, errors.Errorf("unknown storage type %q", cfg.kind)
+	}
+}
+
+func tsdbOptions(cfg tsdbConfig) *tsdb.Options {
+	opts := tsdb.DefaultOptions()
+	opts.RetentionDuration = durationToMillis(cfg.retention)
+	opts.MaxBytes = cfg.maxBytes
+	opts.MinBlockDuration = durationToMillis(cfg.minBlockDuration)
+	opts.WALCompression = cfg.walCompression
+	opts.NoLockfile = cfg.noLockfile
+
+	maxBlockDuration := cfg.maxBlockDuration
+	if maxBlockDuration == 0 {
+		// Same as Prometheus, compacted blocks span at most 10% of the retention, capped at 31 days.
+		maxBlockDuration = cfg.retention / 10 //nolint:gomnd
+		if maxBlockDuration > 31*24*time.Hour {
+			maxBlockDuration = 31 * 24 * time.Hour
+		}
+	}
+
+	if maxBlockDuration < cfg.minBlockDuration {
+		maxBlockDuration = cfg.minBlockDuration
+	}
+
+	opts.MaxBlockDuration = durationToMillis(maxBlockDuration)
+
+	return opts
+}
+
+func durationToMillis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
@@ -11,9 +11,11 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/observatorium/observable-demo/pkg/conntrack"
 	"github.com/observatorium/observable-demo/pkg/lbtransport"
@@ -21,14 +23,21 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"go.opentelemetry.io/otel/api/kv"
+	oteltrace "go.opentelemetry.io/otel/api/trace"
 	"go.opentelemetry.io/otel/exporters/trace/jaeger"
 	"go.opentelemetry.io/otel/instrumentation/othttp"
 	"go.opentelemetry.io/otel/sdk/trace"
 
 	"github.com/kakkoyun/observable-remote-write/internal"
+	"github.com/kakkoyun/observable-remote-write/internal/compression"
+	"github.com/kakkoyun/observable-remote-write/internal/discovery"
 	internalhttp "github.com/kakkoyun/observable-remote-write/internal/http"
 	"github.com/kakkoyun/observable-remote-write/internal/http/middleware"
+	"github.com/kakkoyun/observable-remote-write/internal/proxy"
+	"github.com/kakkoyun/observable-remote-write/internal/queue"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
 )
 
 const (
@@ -39,14 +48,39 @@ const (
 	backoffDuration = 5 * time.Second
 
 	serviceName = "observable_remote_write_proxy"
+
+	modeLoadBalance = "loadbalance"
+	modeHashring    = "hashring"
 )
 
 type config struct {
 	logLevel  string
 	logFormat string
 
-	debug  debugConfig
-	server serverConfig
+	mode string
+
+	debug       debugConfig
+	server      serverConfig
+	hashring    hashringConfig
+	replication replicationConfig
+	queue       queueConfig
+	retry       retryConfig
+	health      healthConfig
+	discovery   discoveryConfig
+	picker      pickerConfig
+	breaker     breakerConfig
+	mirror      mirrorConfig
+	batch       batchConfig
+
+	// pools are the pools of targets requests are forwarded to. Without routes, there is a single pool.
+	pools  []poolConfig
+	routes []proxy.RouteConfig
+
+	relabelConfigs []*relabel.Config
+	externalLabels *proxy.ExternalLabelsConfig
+
+	// upstreamEncoding is the content encoding requests are forwarded in. Requests keep their encoding if empty.
+	upstreamEncoding string
 }
 
 type debugConfig struct {
@@ -61,6 +95,95 @@ type serverConfig struct {
 
 	targets        []url.URL
 	healthcheckURL string
+
+	tenantHeader   string
+	defaultTenant  string
+	allowedTenants []string
+	maxTenants     int
+}
+
+type hashringConfig struct {
+	virtualNodes  int
+	includeTenant bool
+	excludeLabels []string
+}
+
+type replicationConfig struct {
+	factor int
+	quorum int
+}
+
+type poolConfig struct {
+	name     string
+	targets  []url.URL
+	file     string
+	dnsNames []string
+	picker   string
+	weights  map[string]int
+}
+
+type pickerConfig struct {
+	name          string
+	weights       map[string]int
+	defaultWeight int
+	ewmaDecay     time.Duration
+}
+
+type mirrorConfig struct {
+	targets     []url.URL
+	sampleRatio float64
+	maxInFlight int
+	timeout     time.Duration
+}
+
+type batchConfig struct {
+	maxSeries     int
+	maxBytes      int
+	flushInterval time.Duration
+	groupLabels   []string
+}
+
+type breakerConfig struct {
+	enabled        bool
+	window         time.Duration
+	minRequests    int
+	failureRate    float64
+	slowThreshold  time.Duration
+	slowRate       float64
+	openDuration   time.Duration
+	halfOpenProbes int
+}
+
+type discoveryConfig struct {
+	file            string
+	dnsNames        []string
+	dnsServer       string
+	refreshInterval time.Duration
+	scheme          string
+	path            string
+}
+
+type healthConfig struct {
+	interval   time.Duration
+	timeout    time.Duration
+	path       string
+	portOffset int
+}
+
+type retryConfig struct {
+	maxAttempts        int
+	minBackoff         time.Duration
+	maxBackoff         time.Duration
+	budgetRatio        float64
+	budgetMinPerSecond float64
+}
+
+type queueConfig struct {
+	dir        string
+	maxSize    int64
+	maxAge     time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
 }
 
 func main() {
@@ -112,6 +235,9 @@ func main() {
 
 	// Initialize run group.
 	g := &run.Group{}
+
+	var internalOpts []internalhttp.Option
+
 	{
 		// Main server to listen for public APIs.
 		mux := http.NewServeMux()
@@ -120,32 +246,109 @@ func main() {
 		}
 
 		ctx, pCancel := context.WithCancel(context.Background())
-		static := lbtransport.NewStaticDiscovery(cfg.server.targets, reg)
-		picker := lbtransport.NewRoundRobinPicker(ctx, reg, backoffDuration)
-		l7LoadBalancer := &httputil.ReverseProxy{
-			Director:       func(request *http.Request) {},
-			ModifyResponse: func(response *http.Response) error { return nil },
-			Transport: othttp.NewTransport(
-				lbtransport.NewLoadBalancingTransport(static, picker, lbtransport.NewMetrics(reg)),
-				othttp.WithTracer(tracer),
-			),
+
+		var handler http.Handler
+
+		if len(cfg.routes) == 0 {
+			var ready func() error
+
+			handler, ready = newPool(ctx, g, logger, tracer, reg, cfg, cfg.pools[0])
+			if ready != nil {
+				internalOpts = append(internalOpts, internalhttp.WithReadinessCheck("targets", ready))
+			}
+		} else {
+			pools := map[string]http.Handler{}
+
+			for _, p := range cfg.pools {
+				h, ready := newPool(ctx, g, log.With(logger, "pool", p.name), tracer,
+					prometheus.WrapRegistererWith(prometheus.Labels{"pool": p.name}, reg), cfg, p)
+				if ready != nil {
+					internalOpts = append(internalOpts, internalhttp.WithReadinessCheck("targets-"+p.name, ready))
+				}
+
+				pools[p.name] = h
+			}
+
+			handler = proxy.NewRouter(logger, reg, cfg.routes, pools)
+		}
+
+		if cfg.queue.dir != "" {
+			q, err := queue.New(logger, reg, cfg.queue.dir, handler, queue.Options{
+				MaxSize:    cfg.queue.maxSize,
+				MaxAge:     cfg.queue.maxAge,
+				MinBackoff: cfg.queue.minBackoff,
+				MaxBackoff: cfg.queue.maxBackoff,
+				Headers:    append([]string{cfg.server.tenantHeader}, proxy.RouteHeaders(cfg.routes)...),
+			})
+			if err != nil {
+				level.Error(logger).Log("msg", "failed to initialize queue", "err", err)
+				os.Exit(1)
+			}
+
+			handler = q
+
+			qCtx, qCancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				level.Info(logger).Log("msg", "starting queue replay")
+				return q.Run(qCtx)
+			}, func(error) {
+				qCancel()
+			})
+		}
+
+		if len(cfg.mirror.targets) > 0 {
+			handler = proxy.NewMirror(logger, reg, handler, cfg.mirror.targets,
+				&http.Client{Transport: othttp.NewTransport(http.DefaultTransport, othttp.WithTracer(tracer))},
+				proxy.MirrorOptions{
+					TenantHeader: cfg.server.tenantHeader,
+					SampleRatio:  cfg.mirror.sampleRatio,
+					MaxInFlight:  cfg.mirror.maxInFlight,
+					Timeout:      cfg.mirror.timeout,
+				},
+			)
+		}
+
+		if len(cfg.relabelConfigs) > 0 {
+			handler = proxy.NewRelabeler(logger, tracer, reg, handler, cfg.relabelConfigs)
+		}
+
+		// External labels are added before relabeling, like Prometheus does, so that relabel configs can use them.
+		if cfg.externalLabels != nil {
+			handler = proxy.NewExternalLabeler(logger, tracer, reg, handler, *cfg.externalLabels)
 		}
 
+		// Requests are transcoded first, so that the queue, mirrors and pools all see the upstream encoding.
+		if cfg.upstreamEncoding != "" {
+			handler = proxy.NewTranscoder(logger, tracer, reg, handler, cfg.upstreamEncoding)
+		}
+
+		admitter := tenancy.NewAdmitter(cfg.server.allowedTenants, cfg.server.maxTenants)
 		metrics := middleware.NewMetricsMiddleware(reg)
-		mux.Handle("/receive",
+		receive := middleware.Tenant(cfg.server.tenantHeader, cfg.server.defaultTenant, admitter)(
 			metrics.NewHandler("receive-proxy")(
 				middleware.Tracer(logger, tracer, "receive-proxy")(
 					middleware.RequestID(
 						middleware.Logger(logger)(
-							// othttp.NewHandler(
-							l7LoadBalancer,
-							// "receive-proxy", othttp.WithTracer(tracer),
+							middleware.RejectTenant(
+								// othttp.NewHandler(
+								handler,
+								// "receive-proxy", othttp.WithTracer(tracer),
+							),
 						),
 					),
 				),
 			),
 		)
 
+		mux.Handle("/receive", receive)
+
+		// Routes may match requests to other paths.
+		for _, path := range proxy.RoutePaths(cfg.routes) {
+			if path != "/receive" {
+				mux.Handle(path, receive)
+			}
+		}
+
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting server")
 
@@ -183,7 +386,7 @@ func main() {
 
 	// Add internal server.
 	{
-		internalSrv := internalhttp.NewServer(reg, cfg.server.listenInternal, cfg.server.healthcheckURL)
+		internalSrv := internalhttp.NewServer(reg, cfg.server.listenInternal, cfg.server.healthcheckURL, internalOpts...)
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting internal server")
 			return internalSrv.ListenAndServe()
@@ -205,10 +408,183 @@ func main() {
 
 // Helpers
 
+// newPool creates the handler forwarding requests to the given pool of targets,
+// adding the actors discovering and health checking its targets to the run group.
+// It also returns the readiness check of the pool, if its targets are health checked.
+func newPool(
+	ctx context.Context,
+	g *run.Group,
+	logger log.Logger,
+	tracer oteltrace.Tracer,
+	reg prometheus.Registerer,
+	cfg config,
+	p poolConfig,
+) (http.Handler, func() error) {
+	var (
+		ready            func() error
+		sources          []lbtransport.Discovery
+		discoveryMetrics = discovery.NewMetrics(reg)
+		discoveryOpts    = discovery.Options{Scheme: cfg.discovery.scheme, Path: cfg.discovery.path}
+	)
+
+	if len(p.targets) > 0 || (p.file == "" && len(p.dnsNames) == 0) {
+		sources = append(sources, lbtransport.NewStaticDiscovery(p.targets, reg))
+	}
+
+	if p.file != "" {
+		file, err := discovery.NewFile(logger, discoveryMetrics, p.file, cfg.discovery.refreshInterval, discoveryOpts)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to initialize file discovery", "err", err)
+			os.Exit(1)
+		}
+
+		sources = append(sources, file)
+
+		fCtx, fCancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting file discovery")
+			return file.Run(fCtx)
+		}, func(error) {
+			fCancel()
+		})
+	}
+
+	if len(p.dnsNames) > 0 {
+		dns, err := discovery.NewDNS(logger, discoveryMetrics,
+			p.dnsNames, cfg.discovery.dnsServer, cfg.discovery.refreshInterval, discoveryOpts)
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to initialize DNS discovery", "err", err)
+			os.Exit(1)
+		}
+
+		sources = append(sources, dns)
+
+		dCtx, dCancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting DNS discovery")
+			return dns.Run(dCtx)
+		}, func(error) {
+			dCancel()
+		})
+	}
+
+	targets := discovery.Merge(sources...)
+
+	if cfg.health.interval > 0 {
+		health := proxy.NewHealthChecker(logger, reg, targets, proxy.HealthOptions{
+			Interval:   cfg.health.interval,
+			Timeout:    cfg.health.timeout,
+			Path:       cfg.health.path,
+			PortOffset: cfg.health.portOffset,
+		})
+		targets = health
+		ready = health.Ready
+
+		hCtx, hCancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "starting target health checks")
+			return health.Run(hCtx)
+		}, func(error) {
+			hCancel()
+		})
+	}
+
+	retryOpts := proxy.RetryOptions{
+		MaxAttempts:        cfg.retry.maxAttempts,
+		MinBackoff:         cfg.retry.minBackoff,
+		MaxBackoff:         cfg.retry.maxBackoff,
+		BudgetRatio:        cfg.retry.budgetRatio,
+		BudgetMinPerSecond: cfg.retry.budgetMinPerSecond,
+	}
+
+	var handler http.Handler
+
+	switch {
+	case cfg.mode == modeHashring || cfg.replication.factor > 1:
+		handler = proxy.NewDistributor(logger, tracer, reg, targets,
+			&http.Client{Transport: othttp.NewTransport(
+				// Series are owned by their targets, so retries go to the same target.
+				proxy.NewRetryTransport(http.DefaultTransport, tracer, reg, retryOpts),
+				othttp.WithTracer(tracer),
+			)},
+			proxy.DistributorOptions{
+				TenantHeader:      cfg.server.tenantHeader,
+				ShardSeries:       cfg.mode == modeHashring,
+				VirtualNodes:      cfg.hashring.virtualNodes,
+				IncludeTenant:     cfg.hashring.includeTenant,
+				ExcludeLabels:     cfg.hashring.excludeLabels,
+				ReplicationFactor: cfg.replication.factor,
+				Quorum:            cfg.replication.quorum,
+			},
+		)
+	default:
+		var picker lbtransport.TargetPicker
+
+		switch p.picker {
+		case proxy.PickerLeastOutstanding:
+			picker = proxy.NewLeastOutstandingPicker(reg, backoffDuration)
+		case proxy.PickerP2CInFlight, proxy.PickerP2CEWMA:
+			picker = proxy.NewP2CPicker(reg, backoffDuration, p.picker == proxy.PickerP2CEWMA, cfg.picker.ewmaDecay)
+		case proxy.PickerWeighted:
+			picker = proxy.NewWeightedPicker(reg, backoffDuration, p.weights, cfg.picker.defaultWeight)
+		default:
+			picker = lbtransport.NewRoundRobinPicker(ctx, reg, backoffDuration)
+		}
+
+		if cfg.breaker.enabled {
+			picker = proxy.NewCircuitBreaker(picker, logger, tracer, reg, proxy.BreakerOptions{
+				Window:         cfg.breaker.window,
+				MinRequests:    cfg.breaker.minRequests,
+				FailureRate:    cfg.breaker.failureRate,
+				SlowThreshold:  cfg.breaker.slowThreshold,
+				SlowRate:       cfg.breaker.slowRate,
+				OpenDuration:   cfg.breaker.openDuration,
+				HalfOpenProbes: cfg.breaker.halfOpenProbes,
+			})
+		}
+
+		handler = &httputil.ReverseProxy{
+			Director: func(request *http.Request) {
+				// Make sure backends attribute the request to the same tenant, even if the default was applied.
+				request.Header.Set(cfg.server.tenantHeader, tenancy.FromContext(request.Context()))
+			},
+			ModifyResponse: func(response *http.Response) error { return nil },
+			Transport: othttp.NewTransport(
+				proxy.NewRetryTransport(
+					proxy.NewBalancingTransport(targets, picker, reg),
+					tracer, reg, retryOpts,
+				),
+				othttp.WithTracer(tracer),
+			),
+		}
+	}
+
+	// Requests are reshaped per pool, so that routing still sees the requests of clients.
+	if cfg.batch.maxSeries > 0 || cfg.batch.maxBytes > 0 || cfg.batch.flushInterval > 0 {
+		handler = proxy.NewBatcher(logger, tracer, reg, handler, proxy.BatchOptions{
+			MaxSeries:     cfg.batch.maxSeries,
+			MaxBytes:      cfg.batch.maxBytes,
+			FlushInterval: cfg.batch.flushInterval,
+			GroupLabels:   cfg.batch.groupLabels,
+		})
+	}
+
+	return handler, ready
+}
+
 func parseFlags() config {
 	var (
-		cfg        = config{}
-		rawTargets string
+		cfg         = config{}
+		rawTargets  string
+		rawDNSNames string
+		rawWeights  string
+		rawMirrors  string
+		routesFile  string
+		relabelFile string
+		extLblsFile string
+		rawTenants  string
+		rawGroups   string
+		rawExcluded string
 	)
 
 	flag.StringVar(&cfg.debug.name, "debug.name", "observable-remote-write-proxy",
@@ -221,16 +597,224 @@ func parseFlags() config {
 		"The log filtering level. Options: 'error', 'warn', 'info', 'debug'.")
 	flag.StringVar(&cfg.logFormat, "log.format", internal.LogFormatLogfmt,
 		"The log format to use. Options: 'logfmt', 'json'.")
+	flag.StringVar(&cfg.mode, "proxy.mode", modeLoadBalance,
+		"How requests are distributed to the targets. Options: 'loadbalance' forwards whole requests to one target, "+
+			"'hashring' splits requests by series and forwards each series to the target owning it on a consistent hash ring.")
 	flag.StringVar(&cfg.server.listen, "web.listen", ":8090",
 		"The address on which the public server listens.")
 	flag.StringVar(&rawTargets, "web.targets", "",
 		"Comma-separated URLs for target to load balance to.")
+	flag.StringVar(&routesFile, "proxy.routes-file", "",
+		"Path to a YAML file of named pools of targets and the routes of requests to them, by tenant, path, header "+
+			"or external labels. Replaces the targets and discovery flags. Pools use the configured mode, retries, "+
+			"health checks and circuit breaker.")
+	flag.StringVar(&relabelFile, "proxy.relabel-config-file", "",
+		"Path to a YAML file of Prometheus relabel configs to apply to every series before forwarding. "+
+			"Series dropped by the configs are not forwarded.")
+	flag.StringVar(&extLblsFile, "proxy.external-labels-file", "",
+		"Path to a YAML file of external labels to add to every series before forwarding, with overrides per tenant.")
+	flag.StringVar(&cfg.upstreamEncoding, "proxy.upstream-encoding", "",
+		"The content encoding to forward requests in. Options: '"+strings.Join(compression.Encodings, "', '")+"'. "+
+			"Requests keep the encoding they were received in if empty.")
+	flag.StringVar(&rawMirrors, "web.mirror-targets", "",
+		"Comma-separated URLs of shadow targets to copy requests to. Their responses are ignored.")
+	flag.Float64Var(&cfg.mirror.sampleRatio, "mirror.sample-ratio", 1,
+		"The fraction of requests that are copied to the shadow targets.")
+	flag.IntVar(&cfg.mirror.maxInFlight, "mirror.max-in-flight", 100,
+		"The maximum number of copied requests in flight per shadow target. Further copies are dropped.")
+	flag.DurationVar(&cfg.mirror.timeout, "mirror.timeout", 10*time.Second,
+		"The time after which copied requests to shadow targets are canceled.")
 	flag.StringVar(&cfg.server.listenInternal, "web.internal.listen", ":8091",
 		"The address on which the internal server listens.")
 	flag.StringVar(&cfg.server.healthcheckURL, "web.healthchecks.url", "http://127.0.0.1:8090",
 		"The URL against which to run healthchecks.")
+	flag.StringVar(&cfg.server.tenantHeader, "web.tenant-header", tenancy.DefaultTenantHeader,
+		"The HTTP header to read the tenant of a request from. It is forwarded to the targets as is.")
+	flag.StringVar(&cfg.server.defaultTenant, "web.default-tenant", tenancy.DefaultTenant,
+		"The tenant to attribute requests without a tenant header to.")
+	flag.StringVar(&rawTenants, "web.allowed-tenants", "",
+		"Comma-separated tenants to accept requests from, besides the default tenant. Any tenant is accepted if empty.")
+	flag.IntVar(&cfg.server.maxTenants, "web.max-tenants", 1000,
+		"The maximum number of distinct tenants to accept requests from, besides the default tenant. "+
+			"Requests of further tenants are rejected with 403. No limit applies if 0.")
+	flag.StringVar(&cfg.picker.name, "proxy.picker", proxy.PickerRoundRobin,
+		"How targets are picked for requests in 'loadbalance' mode. Options: 'round-robin', 'least-outstanding', "+
+			"'p2c-inflight' and 'p2c-ewma' for the less loaded of two random targets by requests in flight or latency, "+
+			"'weighted' for static weights.")
+	flag.StringVar(&rawWeights, "picker.weights", "",
+		"Comma-separated weights of targets for the 'weighted' picker, as <target URL>=<weight>.")
+	flag.IntVar(&cfg.picker.defaultWeight, "picker.default-weight", 1,
+		"The weight of targets without a configured weight for the 'weighted' picker.")
+	flag.DurationVar(&cfg.picker.ewmaDecay, "picker.ewma-decay", 10*time.Second,
+		"The time constant the latency average of the 'p2c-ewma' picker decays with.")
+	flag.IntVar(&cfg.hashring.virtualNodes, "hashring.virtual-nodes", 128,
+		"The number of virtual nodes each target owns on the hash ring.")
+	flag.BoolVar(&cfg.hashring.includeTenant, "hashring.include-tenant", false,
+		"Include the tenant in the series hash, so that the series of each tenant are sharded independently.")
+	flag.StringVar(&rawExcluded, "hashring.exclude-labels", "__replica__",
+		"Comma-separated names of labels left out of the series hash. Excluding the HA replica label writes the copies "+
+			"of a series of all replicas to the same targets, so that the HA tracker of the targets deduplicates them.")
+	flag.IntVar(&cfg.replication.factor, "replication.factor", 1,
+		"The number of distinct targets every series is written to. "+
+			"In 'loadbalance' mode, whole requests are written to that many targets in turn.")
+	flag.IntVar(&cfg.replication.quorum, "replication.quorum", 0,
+		"The number of targets that have to acknowledge every series for a request to succeed. "+
+			"Defaults to a majority of the replication factor.")
+	flag.StringVar(&cfg.discovery.file, "discovery.file", "",
+		"A JSON or YAML file listing targets in the format of Prometheus file based service discovery. "+
+			"It is read again whenever it changes, and on the refresh interval.")
+	flag.StringVar(&rawDNSNames, "discovery.dns", "",
+		"Comma-separated DNS names to resolve targets from, re-resolved on the refresh interval. "+
+			"Use 'dns+<host>:<port>' for A/AAAA records and 'dnssrv+<name>' for SRV records.")
+	flag.StringVar(&cfg.discovery.dnsServer, "discovery.dns.server", "",
+		"The address of the DNS server to resolve targets with. The system resolver is used if empty.")
+	flag.DurationVar(&cfg.discovery.refreshInterval, "discovery.refresh-interval", 30*time.Second,
+		"The interval to refresh discovered targets on.")
+	flag.StringVar(&cfg.discovery.scheme, "discovery.scheme", "http",
+		"The scheme of discovered targets given without one.")
+	flag.StringVar(&cfg.discovery.path, "discovery.path", "/receive",
+		"The path of discovered targets given without one.")
+	flag.DurationVar(&cfg.health.interval, "health.interval", 0,
+		"The interval to probe the readiness of the targets on. Unhealthy targets are taken out of rotation. "+
+			"Health checking is disabled if 0.")
+	flag.DurationVar(&cfg.health.timeout, "health.timeout", time.Second,
+		"The time after which a readiness probe of a target is considered failed.")
+	flag.StringVar(&cfg.health.path, "health.path", "/-/ready",
+		"The path of the readiness endpoint of the targets.")
+	flag.IntVar(&cfg.health.portOffset, "health.port-offset", 1,
+		"The difference between the port of the internal server of a target, that serves the readiness endpoint, "+
+			"and the port of the target. The default fits the default ports of the backend, 8080 and 8081.")
+	flag.BoolVar(&cfg.breaker.enabled, "breaker.enabled", false,
+		"Stop sending requests to targets that fail or are slow, until probe requests succeed again. "+
+			"Only applies to the 'loadbalance' mode without replication.")
+	flag.DurationVar(&cfg.breaker.window, "breaker.window", 30*time.Second,
+		"The sliding window the error and slow request rates of a target are computed over.")
+	flag.IntVar(&cfg.breaker.minRequests, "breaker.min-requests", 10,
+		"The number of requests to a target within the window below which its circuit does not open.")
+	flag.Float64Var(&cfg.breaker.failureRate, "breaker.failure-rate", 0.5,
+		"The rate of requests to a target failing with an error or a server error at which its circuit opens.")
+	flag.DurationVar(&cfg.breaker.slowThreshold, "breaker.slow-threshold", 5*time.Second,
+		"The duration above which requests to a target are considered slow.")
+	flag.Float64Var(&cfg.breaker.slowRate, "breaker.slow-rate", 0.5,
+		"The rate of slow requests to a target at which its circuit opens.")
+	flag.DurationVar(&cfg.breaker.openDuration, "breaker.open-duration", 10*time.Second,
+		"The time a circuit stays open before probe requests are sent to its target.")
+	flag.IntVar(&cfg.breaker.halfOpenProbes, "breaker.half-open-probes", 3,
+		"The number of probe requests to a target that have to succeed for its circuit to close again.")
+	flag.IntVar(&cfg.batch.maxSeries, "batch.max-series", 0,
+		"The maximum number of series of a forwarded request. Larger requests are split. No limit applies if 0.")
+	flag.IntVar(&cfg.batch.maxBytes, "batch.max-bytes", 0,
+		"The maximum uncompressed size of a forwarded request. Larger requests are split. No limit applies if 0.")
+	flag.DurationVar(&cfg.batch.flushInterval, "batch.flush-interval", 0,
+		"The time to hold back requests to coalesce them with other requests of the same tenant and group labels, "+
+			"up to the maximum number of series and size. Requests are not coalesced if 0.")
+	flag.StringVar(&rawGroups, "batch.group-labels", "cluster,__replica__",
+		"Comma-separated names of labels, like the external labels identifying HA replicas, that requests are only "+
+			"coalesced with requests of equal values of. Values are taken from the first series of a request.")
+	flag.IntVar(&cfg.retry.maxAttempts, "retry.max-attempts", 3,
+		"The maximum number of attempts to forward a request, including the first one. Set to 1 to disable retries.")
+	flag.DurationVar(&cfg.retry.minBackoff, "retry.min-backoff", 100*time.Millisecond,
+		"The time to wait before the first retry. It doubles with every further retry.")
+	flag.DurationVar(&cfg.retry.maxBackoff, "retry.max-backoff", 5*time.Second,
+		"The maximum time to wait before a retry. Responses with a longer Retry-After are returned to the client.")
+	flag.Float64Var(&cfg.retry.budgetRatio, "retry.budget-ratio", 0.2,
+		"The number of retries allowed per forwarded request, on average.")
+	flag.Float64Var(&cfg.retry.budgetMinPerSecond, "retry.budget-min-per-second", 1,
+		"The number of retries allowed per second regardless of the number of forwarded requests.")
+	flag.StringVar(&cfg.queue.dir, "queue.dir", "",
+		"The directory of the on-disk queue that takes requests while the targets fail. The queue is disabled if empty.")
+	flag.Int64Var(&cfg.queue.maxSize, "queue.max-size-bytes", 1<<30,
+		"The maximum size of the queued requests. Requests that do not fit are answered with 503.")
+	flag.DurationVar(&cfg.queue.maxAge, "queue.max-age", 6*time.Hour,
+		"The age after which queued requests are dropped instead of replayed.")
+	flag.DurationVar(&cfg.queue.minBackoff, "queue.min-backoff", time.Second,
+		"The initial time to wait before replaying queued requests again after a failure.")
+	flag.DurationVar(&cfg.queue.maxBackoff, "queue.max-backoff", time.Minute,
+		"The maximum time to wait before replaying queued requests again after a failure.")
 	flag.Parse()
 
+	for _, tenant := range strings.Split(rawTenants, ",") {
+		if tenant == "" {
+			continue
+		}
+
+		if err := tenancy.Validate(tenant); err != nil {
+			stdlog.Fatalf("invalid allowed tenant; err: %v", err)
+		}
+
+		cfg.server.allowedTenants = append(cfg.server.allowedTenants, tenant)
+	}
+
+	if cfg.server.maxTenants < 0 {
+		stdlog.Fatalf("maximum number of tenants must not be negative")
+	}
+
+	switch cfg.mode {
+	case modeLoadBalance, modeHashring:
+	default:
+		stdlog.Fatalf("unknown proxy mode %q", cfg.mode)
+	}
+
+	switch cfg.picker.name {
+	case proxy.PickerRoundRobin, proxy.PickerLeastOutstanding, proxy.PickerP2CInFlight, proxy.PickerP2CEWMA, proxy.PickerWeighted:
+	default:
+		stdlog.Fatalf("unknown picker %q", cfg.picker.name)
+	}
+
+	cfg.picker.weights = map[string]int{}
+
+	for _, w := range strings.Split(rawWeights, ",") {
+		if w == "" {
+			continue
+		}
+
+		i := strings.LastIndex(w, "=")
+		if i < 0 {
+			stdlog.Fatalf("failed to parse weight %v; expected <target URL>=<weight>", w)
+		}
+
+		weight, err := strconv.Atoi(w[i+1:])
+		if err != nil || weight < 0 {
+			stdlog.Fatalf("failed to parse weight %v; err: %v", w, err)
+		}
+
+		cfg.picker.weights[w[:i]] = weight
+	}
+
+	if cfg.breaker.enabled && cfg.breaker.window < 10*time.Millisecond {
+		stdlog.Fatalf("breaker window must be at least 10ms, got %v", cfg.breaker.window)
+	}
+
+	if cfg.replication.factor < 1 {
+		stdlog.Fatalf("replication factor must be at least 1, got %d", cfg.replication.factor)
+	}
+
+	if cfg.replication.quorum < 0 {
+		stdlog.Fatalf("replication quorum must not be negative, got %d", cfg.replication.quorum)
+	}
+
+	if cfg.replication.quorum > cfg.replication.factor {
+		stdlog.Fatalf("replication quorum %d exceeds replication factor %d", cfg.replication.quorum, cfg.replication.factor)
+	}
+
+	for _, name := range strings.Split(rawExcluded, ",") {
+		if name != "" {
+			cfg.hashring.excludeLabels = append(cfg.hashring.excludeLabels, name)
+		}
+	}
+
+	for _, name := range strings.Split(rawGroups, ",") {
+		if name != "" {
+			cfg.batch.groupLabels = append(cfg.batch.groupLabels, name)
+		}
+	}
+
+	for _, name := range strings.Split(rawDNSNames, ",") {
+		if name != "" {
+			cfg.discovery.dnsNames = append(cfg.discovery.dnsNames, name)
+		}
+	}
+
 	for _, addr := range strings.Split(rawTargets, ",") {
 		if addr == "" {
 			continue
@@ -244,5 +828,105 @@ func parseFlags() config {
 		cfg.server.targets = append(cfg.server.targets, *u)
 	}
 
+	if routesFile == "" {
+		cfg.pools = []poolConfig{{
+			targets:  cfg.server.targets,
+			file:     cfg.discovery.file,
+			dnsNames: cfg.discovery.dnsNames,
+			picker:   cfg.picker.name,
+			weights:  cfg.picker.weights,
+		}}
+	} else {
+		if len(cfg.server.targets) > 0 || cfg.discovery.file != "" || len(cfg.discovery.dnsNames) > 0 {
+			stdlog.Fatalf("targets and discovery flags cannot be combined with a routes file")
+		}
+
+		routing, err := proxy.LoadRoutingConfig(routesFile)
+		if err != nil {
+			stdlog.Fatalf("failed to load routes file %v; err: %v", routesFile, err)
+		}
+
+		for _, p := range routing.Pools {
+			pool := poolConfig{name: p.Name, file: p.File, dnsNames: p.DNS, picker: p.Picker, weights: p.Weights}
+			if pool.picker == "" {
+				pool.picker = proxy.PickerRoundRobin
+			}
+
+			for _, addr := range p.Targets {
+				u, err := url.Parse(addr)
+				if err != nil {
+					stdlog.Fatalf("failed to parse target %v of pool %v; err: %v", addr, p.Name, err)
+				}
+
+				pool.targets = append(pool.targets, *u)
+			}
+
+			cfg.pools = append(cfg.pools, pool)
+		}
+
+		cfg.routes = routing.Routes
+	}
+
+	// Distributed requests are sent to the targets owning their series, so targets are not picked.
+	if cfg.mode == modeHashring || cfg.replication.factor > 1 {
+		if cfg.breaker.enabled {
+			stdlog.Fatalf("the circuit breaker only applies to the %q mode without replication", modeLoadBalance)
+		}
+
+		for _, p := range cfg.pools {
+			if p.picker != proxy.PickerRoundRobin {
+				stdlog.Fatalf("picker %q only applies to the %q mode without replication", p.picker, modeLoadBalance)
+			}
+		}
+	}
+
+	if cfg.upstreamEncoding != "" {
+		enc, err := compression.Parse(cfg.upstreamEncoding)
+		if err != nil {
+			stdlog.Fatalf("invalid upstream encoding; err: %v", err)
+		}
+
+		cfg.upstreamEncoding = enc
+	}
+
+	if relabelFile != "" {
+		relabelConfigs, err := proxy.LoadRelabelConfigs(relabelFile)
+		if err != nil {
+			stdlog.Fatalf("failed to load relabel config file %v; err: %v", relabelFile, err)
+		}
+
+		cfg.relabelConfigs = relabelConfigs
+	}
+
+	if extLblsFile != "" {
+		externalLabels, err := proxy.LoadExternalLabelsConfig(extLblsFile)
+		if err != nil {
+			stdlog.Fatalf("failed to load external labels file %v; err: %v", extLblsFile, err)
+		}
+
+		cfg.externalLabels = externalLabels
+	}
+
+	for _, addr := range strings.Split(rawMirrors, ",") {
+		if addr == "" {
+			continue
+		}
+
+		u, err := url.Parse(addr)
+		if err != nil {
+			stdlog.Fatalf("failed to parse mirror target %v; err: %v", addr, err)
+		}
+
+		cfg.mirror.targets = append(cfg.mirror.targets, *u)
+	}
+
+	if cfg.mirror.sampleRatio < 0 || cfg.mirror.sampleRatio > 1 {
+		stdlog.Fatalf("mirror sample ratio must be between 0 and 1, got %v", cfg.mirror.sampleRatio)
+	}
+
+	if cfg.mirror.maxInFlight < 1 {
+		stdlog.Fatalf("mirror max in-flight requests must be at least 1, got %d", cfg.mirror.maxInFlight)
+	}
+
 	return cfg
 }
@@ -14,7 +14,10 @@ for i in $(seq 0 2); do
   (
     backend \
       --web.listen=0.0.0.0:808"${i}" \
-      --web.internal.listen=0.0.0.0:818"${i}"
+      --web.internal.listen=0.0.0.0:818"${i}" \
+      --web.healthchecks.url=http://127.0.0.1:808"${i}" \
+      --storage.type=tsdb \
+      --tsdb.path=data/backend"${i}"
   ) &
   TARGETS="${TARGETS},http://127.0.0.1:808${i}/receive"
 done
@@ -23,7 +26,9 @@ done
   proxy \
     --web.listen=0.0.0.0:8090 \
     --web.internal.listen=0.0.0.0:8091 \
-    --web.targets="$TARGETS"
+    --web.targets="$TARGETS" \
+    --health.interval=5s \
+    --health.port-offset=100
 ) &
 
 echo "-------------------------------------------"
@@ -3,10 +3,13 @@ module github.com/kakkoyun/observable-remote-write
 go 1.14
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.1
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/go-kit/kit v0.10.0
 	github.com/gogo/protobuf v1.3.1
 	github.com/golang/snappy v0.0.1
+	github.com/klauspost/compress v1.10.10
 	github.com/metalmatze/signal v0.0.0-20200616171423-be84551ba3ce
 	github.com/observatorium/observable-demo v0.0.0-20200126103321-15a3f707e7aa
 	github.com/oklog/run v1.1.0
@@ -18,4 +21,6 @@ require (
 	github.com/prometheus/prometheus v1.8.2-0.20200724102142-6b7ac2ac1b66
 	go.opentelemetry.io/otel v0.9.0
 	go.opentelemetry.io/otel/exporters/trace/jaeger v0.9.0
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	gopkg.in/yaml.v2 v2.3.0
 )
@@ -0,0 +1,492 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/kakkoyun/observable-remote-write/internal/cardinality"
+	"github.com/kakkoyun/observable-remote-write/internal/metadata"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const (
+	statusSuccess = "success"
+	statusError   = "error"
+)
+
+const (
+	errorBadData  = "bad_data"
+	errorExec     = "execution"
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+	errorInternal = "internal"
+)
+
+// defaultStatsLimit is the number of entries returned per top-N list unless requested otherwise.
+const defaultStatsLimit = 10
+
+// maxPointsPerSeries limits the resolution of range queries, same as Prometheus.
+const maxPointsPerSeries = 11000
+
+var (
+	minTime = time.Unix(math.MinInt64/1000+62135596801, 0).UTC()
+	maxTime = time.Unix(math.MaxInt64/1000-62135596801, 999999999).UTC()
+)
+
+// Instrument wraps an endpoint handler with the given name, e.g. with metrics, tracing and logging middlewares.
+type Instrument func(name string, h http.Handler) http.Handler
+
+// CardinalityStatser is the interface that wraps the Stats method.
+//
+// Stats returns the top-N statistics of the active series of the given tenant.
+type CardinalityStatser interface {
+	Stats(tenant string, limit int) *cardinality.Stats
+}
+
+// MetadataGetter is the interface that wraps the Metadata method.
+//
+// Metadata returns the metric metadata of the given tenant by metric family name.
+type MetadataGetter interface {
+	Metadata(tenant, metric string, limit int) map[string][]metadata.Metadata
+}
+
+// API serves a subset of the Prometheus HTTP API over the given queryable.
+type API struct {
+	logger      log.Logger
+	engine      *promql.Engine
+	queryable   storage.Queryable
+	cardinality CardinalityStatser
+	metadata    MetadataGetter
+	now         func() time.Time
+}
+
+// New creates a new API that evaluates queries with the given engine over the given queryable
+// and serves active series statistics and metric metadata from the given sources.
+func New(
+	logger log.Logger,
+	engine *promql.Engine,
+	queryable storage.Queryable,
+	cardinality CardinalityStatser,
+	metadata MetadataGetter,
+) *API {
+	return &API{
+		logger:      logger,
+		engine:      engine,
+		queryable:   queryable,
+		cardinality: cardinality,
+		metadata:    metadata,
+		now:         time.Now,
+	}
+}
+
+// Register registers all endpoints of the API on the given router.
+func (a *API) Register(r chi.Router, instrument Instrument) {
+	for _, e := range []struct {
+		pattern string
+		name    string
+		f       apiFunc
+	}{
+		{"/query", "query", a.query},
+		{"/query_range", "query_range", a.queryRange},
+		{"/series", "series", a.series},
+		{"/labels", "labels", a.labelNames},
+		{"/label/{name}/values", "label_values", a.labelValues},
+		{"/status/cardinality", "cardinality", a.cardinalityStats},
+		{"/metadata", "metadata", a.metricMetadata},
+	} {
+		h := instrument(e.name, a.wrap(e.f))
+		r.Method(http.MethodGet, e.pattern, h)
+		r.Method(http.MethodPost, e.pattern, h)
+	}
+}
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+type apiError struct {
+	typ string
+	err error
+}
+
+type apiFuncResult struct {
+	data     interface{}
+	err      *apiError
+	warnings storage.Warnings
+}
+
+type apiFunc func(r *http.Request) apiFuncResult
+
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+func (a *API) wrap(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := f(r)
+
+		warnings := make([]string, 0, len(res.warnings))
+		for _, w := range res.warnings {
+			warnings = append(warnings, w.Error())
+		}
+
+		if res.err != nil {
+			a.respond(w, errorStatusCode(res.err.typ), &response{
+				Status:    statusError,
+				ErrorType: res.err.typ,
+				Error:     res.err.err.Error(),
+				Data:      res.data,
+				Warnings:  warnings,
+			})
+
+			return
+		}
+
+		a.respond(w, http.StatusOK, &response{
+			Status:   statusSuccess,
+			Data:     res.data,
+			Warnings: warnings,
+		})
+	}
+}
+
+func (a *API) respond(w http.ResponseWriter, code int, resp *response) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		level.Error(a.logger).Log("msg", "failed to marshal response", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if n, err := w.Write(b); err != nil {
+		level.Error(a.logger).Log("msg", "failed to write response", "bytesWritten", n, "err", err)
+	}
+}
+
+func errorStatusCode(typ string) int {
+	switch typ {
+	case errorBadData:
+		return http.StatusBadRequest
+	case errorExec:
+		return http.StatusUnprocessableEntity
+	case errorCanceled, errorTimeout:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (a *API) query(r *http.Request) apiFuncResult {
+	ts, err := parseTimeParam(r, "time", a.now())
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, err}}
+	}
+
+	ctx, cancel, err := contextWithTimeout(r)
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, err}}
+	}
+	defer cancel()
+
+	qry, err := a.engine.NewInstantQuery(a.queryable, r.FormValue("query"), ts)
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'query'")}}
+	}
+	defer qry.Close()
+
+	return queryResult(qry.Exec(ctx))
+}
+
+func (a *API) queryRange(r *http.Request) apiFuncResult {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'start'")}}
+	}
+
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'end'")}}
+	}
+
+	if end.Before(start) {
+		return apiFuncResult{err: &apiError{errorBadData, errors.New("end timestamp must not be before start time")}}
+	}
+
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'step'")}}
+	}
+
+	if step <= 0 {
+		return apiFuncResult{err: &apiError{errorBadData, errors.New("zero or negative query resolution step widths are not accepted")}}
+	}
+
+	if end.Sub(start)/step > maxPointsPerSeries {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Errorf("exceeded maximum resolution of %d points per timeseries", maxPointsPerSeries)}}
+	}
+
+	ctx, cancel, err := contextWithTimeout(r)
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, err}}
+	}
+	defer cancel()
+
+	qry, err := a.engine.NewRangeQuery(a.queryable, r.FormValue("query"), start, end, step)
+	if err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "invalid parameter 'query'")}}
+	}
+	defer qry.Close()
+
+	return queryResult(qry.Exec(ctx))
+}
+
+func (a *API) series(r *http.Request) apiFuncResult {
+	if err := r.ParseForm(); err != nil {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Wrap(err, "parse form")}}
+	}
+
+	if len(r.Form["match[]"]) == 0 {
+		return apiFuncResult{err: &apiError{errorBadData, errors.New("no match[] parameter provided")}}
+	}
+
+	matcherSets := make([][]*labels.Matcher, 0, len(r.Form["match[]"]))
+
+	for _, s := range r.Form["match[]"] {
+		matchers, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			return apiFuncResult{err: &apiError{errorBadData, err}}
+		}
+
+		matcherSets = append(matcherSets, matchers)
+	}
+
+	q, err := a.querier(r)
+	if err != nil {
+		return apiFuncResult{err: err}
+	}
+	defer q.Close()
+
+	sets := make([]storage.SeriesSet, 0, len(matcherSets))
+	for _, ms := range matcherSets {
+		sets = append(sets, q.Select(len(matcherSets) > 1, nil, ms...))
+	}
+
+	set := storage.NewMergeSeriesSet(sets, storage.ChainedSeriesMerge)
+
+	metrics := []labels.Labels{}
+	for set.Next() {
+		metrics = append(metrics, set.At().Labels())
+	}
+
+	if err := set.Err(); err != nil {
+		return apiFuncResult{err: &apiError{errorExec, err}, warnings: set.Warnings()}
+	}
+
+	return apiFuncResult{data: metrics, warnings: set.Warnings()}
+}
+
+func (a *API) labelNames(r *http.Request) apiFuncResult {
+	q, err := a.querier(r)
+	if err != nil {
+		return apiFuncResult{err: err}
+	}
+	defer q.Close()
+
+	names, warnings, qerr := q.LabelNames()
+	if qerr != nil {
+		return apiFuncResult{err: &apiError{errorExec, qerr}, warnings: warnings}
+	}
+
+	if names == nil {
+		names = []string{}
+	}
+
+	return apiFuncResult{data: names, warnings: warnings}
+}
+
+func (a *API) labelValues(r *http.Request) apiFuncResult {
+	name := chi.URLParam(r, "name")
+	if !model.LabelNameRE.MatchString(name) {
+		return apiFuncResult{err: &apiError{errorBadData, errors.Errorf("invalid label name: %q", name)}}
+	}
+
+	q, err := a.querier(r)
+	if err != nil {
+		return apiFuncResult{err: err}
+	}
+	defer q.Close()
+
+	values, warnings, qerr := q.LabelValues(name)
+	if qerr != nil {
+		return apiFuncResult{err: &apiError{errorExec, qerr}, warnings: warnings}
+	}
+
+	if values == nil {
+		values = []string{}
+	}
+
+	return apiFuncResult{data: values, warnings: warnings}
+}
+
+func (a *API) cardinalityStats(r *http.Request) apiFuncResult {
+	limit := defaultStatsLimit
+
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return apiFuncResult{err: &apiError{errorBadData, errors.Errorf("invalid parameter 'limit': %q", s)}}
+		}
+	}
+
+	return apiFuncResult{data: a.cardinality.Stats(tenancy.FromContext(r.Context()), limit)}
+}
+
+func (a *API) metricMetadata(r *http.Request) apiFuncResult {
+	limit := -1
+
+	if s := r.FormValue("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil {
+			return apiFuncResult{err: &apiError{errorBadData, errors.New("limit must be a number")}}
+		}
+	}
+
+	return apiFuncResult{data: a.metadata.Metadata(tenancy.FromContext(r.Context()), r.FormValue("metric"), limit)}
+}
+
+// querier opens a querier over the time range given by the optional start and end parameters.
+func (a *API) querier(r *http.Request) (storage.Querier, *apiError) {
+	start, err := parseTimeParam(r, "start", minTime)
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+
+	end, err := parseTimeParam(r, "end", maxTime)
+	if err != nil {
+		return nil, &apiError{errorBadData, err}
+	}
+
+	q, err := a.queryable.Querier(r.Context(), timestamp.FromTime(start), timestamp.FromTime(end))
+	if err != nil {
+		return nil, &apiError{errorExec, err}
+	}
+
+	return q, nil
+}
+
+func queryResult(res *promql.Result) apiFuncResult {
+	if res.Err != nil {
+		return apiFuncResult{err: queryError(res.Err), warnings: res.Warnings}
+	}
+
+	return apiFuncResult{
+		data: &queryData{
+			ResultType: res.Value.Type(),
+			Result:     res.Value,
+		},
+		warnings: res.Warnings,
+	}
+}
+
+func queryError(err error) *apiError {
+	switch errors.Cause(err).(type) {
+	case promql.ErrQueryCanceled:
+		return &apiError{errorCanceled, err}
+	case promql.ErrQueryTimeout:
+		return &apiError{errorTimeout, err}
+	case promql.ErrStorage:
+		return &apiError{errorInternal, err}
+	}
+
+	return &apiError{errorExec, err}
+}
+
+// contextWithTimeout derives the query context from the request, honouring the optional timeout parameter.
+func contextWithTimeout(r *http.Request) (context.Context, context.CancelFunc, error) {
+	to := r.FormValue("timeout")
+	if to == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+
+	timeout, err := parseDuration(to)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid parameter 'timeout'")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+
+	return ctx, cancel, nil
+}
+
+func parseTimeParam(r *http.Request, name string, defaultValue time.Time) (time.Time, error) {
+	val := r.FormValue(name)
+	if val == "" {
+		return defaultValue, nil
+	}
+
+	t, err := parseTime(val)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid parameter '%s'", name)
+	}
+
+	return t, nil
+}
+
+// parseTime parses either a Unix timestamp with optional decimal places or an RFC3339 timestamp.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000 //nolint:gomnd
+
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, errors.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses either a number of seconds with optional decimal places or a Prometheus duration.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, errors.Errorf("cannot parse %q to a valid duration, it overflows int64", s)
+		}
+
+		return time.Duration(ts), nil
+	}
+
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+
+	return 0, errors.Errorf("cannot parse %q to a valid duration", s)
+}
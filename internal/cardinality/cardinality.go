@@ -0,0 +1,205 @@
+package cardinality
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/receiver"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const metricName = "__name__"
+
+// Stat is a single entry of a top-N list.
+type Stat struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+// Stats summarises the active series of a tenant.
+type Stats struct {
+	SeriesCount                 int    `json:"seriesCount"`
+	SeriesCountByMetricName     []Stat `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []Stat `json:"labelValueCountByLabelName"`
+	SeriesCountByLabelValuePair []Stat `json:"seriesCountByLabelValuePair"`
+}
+
+type activeSeries struct {
+	labels   []prompb.Label
+	lastSeen time.Time
+}
+
+// Tracker is an appender that keeps an in-memory view of the series appended within a window, per tenant,
+// after handing the request to the next appender.
+type Tracker struct {
+	next   receiver.Appender
+	window time.Duration
+
+	mtx     sync.Mutex
+	tenants map[string]map[string]*activeSeries
+	lastGC  time.Time
+
+	active *prometheus.GaugeVec
+}
+
+// NewTracker creates a new appender that tracks the series appended to the given appender.
+// Series are considered active until they did not receive samples for the given window.
+func NewTracker(next receiver.Appender, reg prometheus.Registerer, window time.Duration) *Tracker {
+	return &Tracker{
+		next:    next,
+		window:  window,
+		tenants: map[string]map[string]*activeSeries{},
+		lastGC:  time.Now(),
+		active: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "receiver_active_series",
+				Help: "The number of series that received samples within the active series window.",
+			},
+			[]string{"tenant"},
+		),
+	}
+}
+
+// Append hands the request to the next appender and marks its series as active if that succeeded.
+func (t *Tracker) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	if err := t.next.Append(ctx, req); err != nil {
+		return err
+	}
+
+	var (
+		now    = time.Now()
+		tenant = tenancy.FromContext(ctx)
+		key    strings.Builder
+	)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	series, ok := t.tenants[tenant]
+	if !ok {
+		series = map[string]*activeSeries{}
+		t.tenants[tenant] = series
+	}
+
+	for _, ts := range req.Timeseries {
+		key.Reset()
+
+		for _, l := range ts.Labels {
+			key.WriteString(l.Name)
+			key.WriteByte('\xff')
+			key.WriteString(l.Value)
+			key.WriteByte('\xff')
+		}
+
+		if s, ok := series[key.String()]; ok {
+			s.lastSeen = now
+			continue
+		}
+
+		// The request must not be retained, so the labels are copied.
+		ls := make([]prompb.Label, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			ls = append(ls, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+
+		series[key.String()] = &activeSeries{labels: ls, lastSeen: now}
+	}
+
+	if now.Sub(t.lastGC) >= t.window {
+		t.gc(now)
+	}
+
+	t.active.WithLabelValues(tenant).Set(float64(len(series)))
+
+	return nil
+}
+
+// Stats returns the top-N statistics of the active series of the given tenant.
+func (t *Tracker) Stats(tenant string, limit int) *Stats {
+	var (
+		now          = time.Now()
+		byMetricName = map[string]int{}
+		byPair       = map[string]int{}
+		valuesByName = map[string]map[string]struct{}{}
+	)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.gc(now)
+
+	series := t.tenants[tenant]
+	for _, s := range series {
+		for _, l := range s.labels {
+			if l.Name == metricName {
+				byMetricName[l.Value]++
+			}
+
+			byPair[l.Name+"="+l.Value]++
+
+			values, ok := valuesByName[l.Name]
+			if !ok {
+				values = map[string]struct{}{}
+				valuesByName[l.Name] = values
+			}
+
+			values[l.Value] = struct{}{}
+		}
+	}
+
+	byName := make(map[string]int, len(valuesByName))
+	for name, values := range valuesByName {
+		byName[name] = len(values)
+	}
+
+	return &Stats{
+		SeriesCount:                 len(series),
+		SeriesCountByMetricName:     topN(byMetricName, limit),
+		LabelValueCountByLabelName:  topN(byName, limit),
+		SeriesCountByLabelValuePair: topN(byPair, limit),
+	}
+}
+
+// gc forgets all series that did not receive samples within the window.
+func (t *Tracker) gc(now time.Time) {
+	for tenant, series := range t.tenants {
+		for key, s := range series {
+			if now.Sub(s.lastSeen) >= t.window {
+				delete(series, key)
+			}
+		}
+
+		t.active.WithLabelValues(tenant).Set(float64(len(series)))
+	}
+
+	t.lastGC = now
+}
+
+// topN returns the given number of entries with the highest counts, ties broken by name.
+func topN(counts map[string]int, n int) []Stat {
+	stats := make([]Stat, 0, len(counts))
+	for name, v := range counts {
+		stats = append(stats, Stat{Name: name, Value: v})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Value != stats[j].Value {
+			return stats[i].Value > stats[j].Value
+		}
+
+		return stats[i].Name < stats[j].Name
+	})
+
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+
+	return stats
+}
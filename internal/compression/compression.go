@@ -0,0 +1,181 @@
+// Package compression implements the content encodings of remote write request bodies.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Content encodings of request bodies.
+const (
+	// Snappy is the snappy block format, as sent by Prometheus.
+	Snappy = "snappy"
+	// SnappyFramed is the snappy framing format.
+	SnappyFramed = "x-snappy-framed"
+	Gzip         = "gzip"
+	Zstd         = "zstd"
+	Identity     = "identity"
+)
+
+// maxDecodedSize is the maximum size of a decoded body of the streaming formats, to guard against decompression bombs.
+const maxDecodedSize = 256 << 20
+
+// Encodings are the supported content encodings, for example to advertise them with Accept-Encoding.
+var Encodings = []string{Snappy, SnappyFramed, Gzip, Zstd, Identity}
+
+// ErrUnsupported is returned for content encodings that are not supported.
+var ErrUnsupported = errors.New("unsupported content encoding")
+
+var (
+	// The zstd encoder and decoder are safe for concurrent use of EncodeAll and DecodeAll.
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedSize))
+)
+
+// Parse returns the content encoding of the given Content-Encoding header.
+// Bodies without one are snappy compressed, as remote write requires.
+func Parse(header string) (string, error) {
+	enc := strings.ToLower(strings.TrimSpace(header))
+	if enc == "" {
+		return Snappy, nil
+	}
+
+	for _, e := range Encodings {
+		if enc == e {
+			return enc, nil
+		}
+	}
+
+	return "", errors.Wrapf(ErrUnsupported, "%q", header)
+}
+
+// Decode decodes the given body of the given content encoding.
+func Decode(enc string, b []byte) ([]byte, error) {
+	switch enc {
+	case Snappy:
+		return snappy.Decode(nil, b)
+	case SnappyFramed:
+		return readAll(snappy.NewReader(bytes.NewReader(b)))
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+
+		return readAll(r)
+	case Zstd:
+		return zstdDecoder.DecodeAll(b, nil)
+	case Identity:
+		return b, nil
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "%q", enc)
+	}
+}
+
+// Encode encodes the given body with the given content encoding.
+func Encode(enc string, b []byte) ([]byte, error) {
+	switch enc {
+	case Snappy:
+		return snappy.Encode(nil, b), nil
+	case SnappyFramed:
+		var buf bytes.Buffer
+
+		w := snappy.NewBufferedWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case Gzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(b, nil), nil
+	case Identity:
+		return b, nil
+	default:
+		return nil, errors.Wrapf(ErrUnsupported, "%q", enc)
+	}
+}
+
+// readAll reads the given decoding reader up to the maximum decoded size.
+func readAll(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > maxDecodedSize {
+		return nil, errors.Errorf("decoded body exceeds %d bytes", maxDecodedSize)
+	}
+
+	return b, nil
+}
+
+// Metrics tracks the sizes of bodies by content encoding.
+type Metrics struct {
+	compressed   *prometheus.CounterVec
+	uncompressed *prometheus.CounterVec
+	ratio        *prometheus.HistogramVec
+}
+
+// NewMetrics creates new metrics of body sizes. Wrap the registerer to give them the prefix of the component.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		compressed: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "compressed_bytes_total",
+				Help: "Tracks the number of encoded bytes of bodies, by content encoding and whether they were decoded or encoded.",
+			},
+			[]string{"encoding", "op"},
+		),
+		uncompressed: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "uncompressed_bytes_total",
+				Help: "Tracks the number of decoded bytes of bodies, by content encoding and whether they were decoded or encoded.",
+			},
+			[]string{"encoding", "op"},
+		),
+		ratio: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "compression_ratio",
+				Help:    "Tracks the ratio of decoded to encoded size of bodies, by content encoding and whether they were decoded or encoded.",
+				Buckets: []float64{1, 1.5, 2, 3, 4, 6, 8, 12, 16, 24, 32},
+			},
+			[]string{"encoding", "op"},
+		),
+	}
+}
+
+// Observe records the encoded and decoded size of a body. The op is either "decode" or "encode".
+func (m *Metrics) Observe(enc, op string, compressed, uncompressed int) {
+	m.compressed.WithLabelValues(enc, op).Add(float64(compressed))
+	m.uncompressed.WithLabelValues(enc, op).Add(float64(uncompressed))
+
+	if compressed > 0 {
+		m.ratio.WithLabelValues(enc, op).Observe(float64(uncompressed) / float64(compressed))
+	}
+}
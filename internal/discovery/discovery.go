@@ -0,0 +1,156 @@
+package discovery
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Options configures how discovered addresses are turned into target URLs.
+type Options struct {
+	// Scheme is the scheme of targets discovered without one.
+	Scheme string
+	// Path is the path of targets discovered without one.
+	Path string
+}
+
+// targetURL parses the given address as target URL, completing addresses given as host and port with the options.
+func (o Options) targetURL(addr string) (url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = o.Scheme + "://" + addr + o.Path
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return url.URL{}, errors.Wrapf(err, "parse target %q", addr)
+	}
+
+	if u.Host == "" {
+		return url.URL{}, errors.Errorf("target %q has no host", addr)
+	}
+
+	return *u, nil
+}
+
+// Metrics are the metrics shared by all discoveries, partitioned by the kind of discovery.
+type Metrics struct {
+	targets   *prometheus.GaugeVec
+	refreshes *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics of discoveries.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return &Metrics{
+		targets: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_discovered_targets",
+				Help: "The number of targets currently discovered.",
+			},
+			[]string{"discovery"},
+		),
+		refreshes: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_discovery_refreshes_total",
+				Help: "Tracks the number of target refreshes.",
+			},
+			[]string{"discovery", "result"},
+		),
+	}
+}
+
+// targetSet holds the current targets of a discovery.
+// Targets keep their identity across refreshes, so that pickers can keep track of them.
+type targetSet struct {
+	mtx     sync.RWMutex
+	targets []*lbtransport.Target
+	byAddr  map[string]*lbtransport.Target
+}
+
+// Targets implements lbtransport.Discovery.
+func (s *targetSet) Targets() []*lbtransport.Target {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.targets
+}
+
+// set replaces the targets with the given URLs, reporting whether they changed.
+func (s *targetSet) set(urls []url.URL) bool {
+	byAddr := make(map[string]*lbtransport.Target, len(urls))
+	addrs := make([]string, 0, len(urls))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, u := range urls {
+		addr := u.String()
+		if _, ok := byAddr[addr]; ok {
+			continue
+		}
+
+		t, ok := s.byAddr[addr]
+		if !ok {
+			t = &lbtransport.Target{DialAddr: u}
+		}
+
+		byAddr[addr] = t
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+
+	changed := len(addrs) != len(s.targets)
+
+	targets := make([]*lbtransport.Target, 0, len(addrs))
+	for i, addr := range addrs {
+		if !changed && s.targets[i].DialAddr.String() != addr {
+			changed = true
+		}
+
+		targets = append(targets, byAddr[addr])
+	}
+
+	s.targets = targets
+	s.byAddr = byAddr
+
+	return changed
+}
+
+// Merge returns a discovery of the targets of all given discoveries.
+func Merge(ds ...lbtransport.Discovery) lbtransport.Discovery {
+	if len(ds) == 1 {
+		return ds[0]
+	}
+
+	return merged(ds)
+}
+
+type merged []lbtransport.Discovery
+
+// Targets implements lbtransport.Discovery.
+func (m merged) Targets() []*lbtransport.Target {
+	var (
+		targets []*lbtransport.Target
+		seen    = map[string]struct{}{}
+	)
+
+	for _, d := range m {
+		for _, t := range d.Targets() {
+			addr := t.DialAddr.String()
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+
+			seen[addr] = struct{}{}
+			targets = append(targets, t)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,195 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+)
+
+const (
+	discoveryDNS = "dns"
+
+	prefixA   = "dns+"
+	prefixSRV = "dnssrv+"
+)
+
+// resolver resolves DNS names. It is implemented by net.Resolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNS is a discovery of the targets a set of DNS names resolve to. The names are resolved again on an interval.
+//
+// Names are given in the format used by Thanos:
+//
+//	dns+backend.example.org:8080            A and AAAA records, with the given port.
+//	dnssrv+_receive._tcp.backend.example.org SRV records, with the ports and the addresses of their targets.
+//
+// Discovered addresses are completed to target URLs with the options.
+type DNS struct {
+	targetSet
+
+	logger   log.Logger
+	names    []string
+	interval time.Duration
+	opts     Options
+	resolver resolver
+	metrics  *Metrics
+}
+
+// NewDNS creates a new discovery of the targets the given names resolve to.
+// If server is not empty, names are resolved by the given DNS server instead of the system resolver.
+// It fails if a name is invalid, but not if it cannot be resolved initially.
+func NewDNS(logger log.Logger, m *Metrics, names []string, server string, interval time.Duration, opts Options) (*DNS, error) {
+	for _, n := range names {
+		switch {
+		case strings.HasPrefix(n, prefixSRV):
+		case strings.HasPrefix(n, prefixA):
+			if _, _, err := net.SplitHostPort(strings.TrimPrefix(n, prefixA)); err != nil {
+				return nil, errors.Wrapf(err, "DNS name %q", n)
+			}
+		default:
+			return nil, errors.Errorf("DNS name %q must start with %q or %q", n, prefixA, prefixSRV)
+		}
+	}
+
+	r := net.DefaultResolver
+	if server != "" {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return newDNS(logger, m, names, r, interval, opts), nil
+}
+
+// newDNS creates a new discovery of the targets the given names resolve to with the given resolver.
+func newDNS(logger log.Logger, m *Metrics, names []string, r resolver, interval time.Duration, opts Options) *DNS {
+	d := &DNS{
+		logger:   logger,
+		names:    names,
+		interval: interval,
+		opts:     opts,
+		resolver: r,
+		metrics:  m,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+
+	if err := d.refresh(ctx); err != nil {
+		level.Warn(logger).Log("msg", "resolve targets", "err", err)
+	}
+
+	return d
+}
+
+// Run resolves the names on the configured interval until the given context is canceled.
+// If a name cannot be resolved, the previous targets are kept.
+func (d *DNS) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		rctx, cancel := context.WithTimeout(ctx, d.interval)
+		err := d.refresh(rctx)
+
+		cancel()
+
+		if err != nil {
+			level.Warn(d.logger).Log("msg", "resolve targets", "err", err)
+		}
+	}
+}
+
+func (d *DNS) refresh(ctx context.Context) error {
+	var urls []url.URL
+
+	for _, n := range d.names {
+		addrs, err := d.resolve(ctx, n)
+		if err != nil {
+			d.metrics.refreshes.WithLabelValues(discoveryDNS, "failure").Inc()
+			return errors.Wrapf(err, "resolve %s", n)
+		}
+
+		for _, addr := range addrs {
+			u, err := d.opts.targetURL(addr)
+			if err != nil {
+				return err
+			}
+
+			urls = append(urls, u)
+		}
+	}
+
+	d.metrics.refreshes.WithLabelValues(discoveryDNS, "success").Inc()
+
+	if d.set(urls) {
+		level.Info(d.logger).Log("msg", "targets changed", "names", strings.Join(d.names, ","), "targets", len(d.Targets()))
+	}
+
+	d.metrics.targets.WithLabelValues(discoveryDNS).Set(float64(len(d.Targets())))
+
+	return nil
+}
+
+// resolve returns the addresses, as host and port, the given name resolves to.
+func (d *DNS) resolve(ctx context.Context, name string) ([]string, error) {
+	if strings.HasPrefix(name, prefixSRV) {
+		_, srvs, err := d.resolver.LookupSRV(ctx, "", "", strings.TrimPrefix(name, prefixSRV))
+		if err != nil {
+			return nil, err
+		}
+
+		var addrs []string
+
+		for _, srv := range srvs {
+			// Targets of SRV records are resolved as well, as they may only be known to the configured DNS server.
+			ips, err := d.resolver.LookupIPAddr(ctx, srv.Target)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ip := range ips {
+				addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))))
+			}
+		}
+
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(name, prefixA))
+	if err != nil {
+		return nil, errors.Wrap(err, "split host and port")
+	}
+
+	ips, err := d.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+
+	return addrs, nil
+}
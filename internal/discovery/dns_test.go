@@ -0,0 +1,284 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stubResolver resolves names from fixed records, standing in for a DNS server.
+type stubResolver struct {
+	ips  map[string][]net.IPAddr
+	srvs map[string][]*net.SRV
+}
+
+func (r *stubResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return ips, nil
+}
+
+func (r *stubResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srvs[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	return name, srvs, nil
+}
+
+func ipAddrs(ips ...string) []net.IPAddr {
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addrs
+}
+
+func TestDNSRefresh(t *testing.T) {
+	r := &stubResolver{
+		ips: map[string][]net.IPAddr{
+			"backend.example.org": ipAddrs("10.0.0.2", "10.0.0.1"),
+			"other.example.org":   ipAddrs("10.0.0.1"),
+			"ipv6.example.org":    ipAddrs("::1"),
+			"backend-0.example":   ipAddrs("10.0.1.1"),
+			"backend-1.example":   ipAddrs("10.0.1.2"),
+		},
+		srvs: map[string][]*net.SRV{
+			"_receive._tcp.backend.example.org": {
+				{Target: "backend-0.example", Port: 19291},
+				{Target: "backend-1.example", Port: 19292},
+			},
+			"_receive._tcp.broken.example.org": {
+				{Target: "unknown.example", Port: 19291},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "A records",
+			names: []string{"dns+backend.example.org:8080"},
+			want:  []string{"http://10.0.0.1:8080/receive", "http://10.0.0.2:8080/receive"},
+		},
+		{
+			name:  "AAAA records",
+			names: []string{"dns+ipv6.example.org:8080"},
+			want:  []string{"http://[::1]:8080/receive"},
+		},
+		{
+			name:  "SRV records",
+			names: []string{"dnssrv+_receive._tcp.backend.example.org"},
+			want:  []string{"http://10.0.1.1:19291/receive", "http://10.0.1.2:19292/receive"},
+		},
+		{
+			name:  "duplicates across names",
+			names: []string{"dns+backend.example.org:8080", "dns+other.example.org:8080"},
+			want:  []string{"http://10.0.0.1:8080/receive", "http://10.0.0.2:8080/receive"},
+		},
+		{
+			name:    "unknown name",
+			names:   []string{"dns+unknown.example.org:8080"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown SRV target",
+			names:   []string{"dnssrv+_receive._tcp.broken.example.org"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDNS(log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()), tc.names, r, time.Minute,
+				Options{Scheme: "http", Path: "/receive"})
+
+			err := d.refresh(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("refresh: got error %v, want error %v", err, tc.wantErr)
+			}
+
+			if got := addrs(d); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got targets %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDNSKeepsTargetsOnFailure(t *testing.T) {
+	r := &stubResolver{ips: map[string][]net.IPAddr{"backend.example.org": ipAddrs("10.0.0.1")}}
+
+	d := newDNS(log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()), []string{"dns+backend.example.org:8080"}, r,
+		time.Minute, Options{Scheme: "http", Path: "/receive"})
+
+	before := d.Targets()
+	if len(before) != 1 {
+		t.Fatalf("got %d targets, want 1", len(before))
+	}
+
+	delete(r.ips, "backend.example.org")
+
+	if err := d.refresh(context.Background()); err == nil {
+		t.Fatal("refresh: got no error, want one")
+	}
+
+	if got := d.Targets(); !reflect.DeepEqual(got, before) {
+		t.Errorf("got targets %v, want %v", addrs(d), before)
+	}
+}
+
+// serveDNS answers A queries for the given names on a local UDP port, like a DNS server, and returns its address.
+// Other names are answered with NXDOMAIN, other query types without answers.
+func serveDNS(t *testing.T, records map[string]net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if resp := answerDNS(buf[:n], records); resp != nil {
+				_, _ = conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// answerDNS returns the response to the given query of a single question.
+func answerDNS(query []byte, records map[string]net.IP) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// The question name is a sequence of length prefixed labels, followed by the query type and class.
+	var (
+		labels []string
+		i      = 12
+	)
+
+	for i < len(query) && query[i] != 0 {
+		l := int(query[i])
+		if i+1+l > len(query) {
+			return nil
+		}
+
+		labels = append(labels, string(query[i+1:i+1+l]))
+		i += 1 + l
+	}
+
+	end := i + 5
+	if end > len(query) {
+		return nil
+	}
+
+	qtype := binary.BigEndian.Uint16(query[i+1 : i+3])
+	ip, ok := records[strings.Join(labels, ".")]
+
+	resp := make([]byte, 12, end+16)
+	copy(resp, query[:2])
+
+	switch {
+	case !ok:
+		binary.BigEndian.PutUint16(resp[2:], 0x8183) // Response, recursion available, NXDOMAIN.
+	default:
+		binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	}
+
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	resp = append(resp, query[12:end]...)
+
+	if ok && qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// The answer points to the name of the question, of type A and class IN, valid for 60s.
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+
+	return resp
+}
+
+func TestNewDNS(t *testing.T) {
+	server := serveDNS(t, map[string]net.IP{
+		"backend.example.org": net.ParseIP("10.0.0.1"),
+		"other.example.org":   net.ParseIP("10.0.0.2"),
+	})
+
+	for _, tc := range []struct {
+		names   []string
+		want    []string
+		wantErr bool
+	}{
+		{
+			names: []string{"dns+backend.example.org:8080"},
+			want:  []string{"http://10.0.0.1:8080/receive"},
+		},
+		{
+			names: []string{"dns+backend.example.org:8080", "dns+other.example.org:8081"},
+			want:  []string{"http://10.0.0.1:8080/receive", "http://10.0.0.2:8081/receive"},
+		},
+		{
+			// Names that cannot be resolved initially do not fail creating the discovery.
+			names: []string{"dns+unknown.example.org:8080"},
+		},
+		{
+			// The SRV record does not exist, which does not fail creating the discovery either.
+			names: []string{"dnssrv+_receive._tcp.backend.example.org"},
+		},
+		{names: []string{"dns+backend.example.org"}, wantErr: true},
+		{names: []string{"backend.example.org:8080"}, wantErr: true},
+	} {
+		t.Run(strings.Join(tc.names, ","), func(t *testing.T) {
+			d, err := NewDNS(log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()), tc.names, server, time.Second,
+				Options{Scheme: "http", Path: "/receive"})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := addrs(d); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got targets %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// addrs returns the addresses of the current targets of the given discovery.
+func addrs(d interface{ Targets() []*lbtransport.Target }) []string {
+	var addrs []string
+	for _, t := range d.Targets() {
+		addrs = append(addrs, t.DialAddr.String())
+	}
+
+	return addrs
+}
@@ -0,0 +1,162 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kakkoyun/observable-remote-write/internal"
+)
+
+const discoveryFile = "file"
+
+// targetGroup is a group of targets in a file, in the format of Prometheus file based service discovery.
+// Labels are accepted for compatibility, but not used.
+type targetGroup struct {
+	Targets []string          `yaml:"targets"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// File is a discovery of the targets listed in a JSON or YAML file.
+// The file is read again whenever it changes, and on an interval in case changes are missed,
+// so that targets can be changed without a restart.
+//
+// The file holds a list of target groups, as used by Prometheus file based service discovery:
+//
+//   - targets: ["http://127.0.0.1:8080/receive", "127.0.0.1:8081"]
+//
+// Targets without scheme and path are completed with the options.
+type File struct {
+	targetSet
+
+	logger   log.Logger
+	path     string
+	interval time.Duration
+	opts     Options
+	metrics  *Metrics
+}
+
+// NewFile creates a new discovery of the targets listed in the given file.
+// It fails if the file cannot be read initially.
+func NewFile(logger log.Logger, m *Metrics, path string, interval time.Duration, opts Options) (*File, error) {
+	f := &File{
+		logger:   logger,
+		path:     path,
+		interval: interval,
+		opts:     opts,
+		metrics:  m,
+	}
+
+	if err := f.refresh(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Run reads the file whenever it changes and on the configured interval until the given context is canceled.
+// If the file cannot be read, the previous targets are kept.
+func (f *File) Run(ctx context.Context) error {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+	)
+
+	if w, err := f.watch(); err != nil {
+		level.Warn(f.logger).Log("msg", "watch file, reading it on the interval only", "file", f.path, "err", err)
+	} else {
+		defer internal.CloseWithLogOnErr(f.logger, w)
+
+		events, errs = w.Events, w.Errors
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-events:
+		case err := <-errs:
+			level.Warn(f.logger).Log("msg", "watch file", "file", f.path, "err", err)
+			continue
+		}
+
+		if err := f.refresh(); err != nil {
+			level.Warn(f.logger).Log("msg", "refresh targets from file", "file", f.path, "err", err)
+		}
+	}
+}
+
+// watch watches the directory of the file rather than the file itself, as files are often replaced instead of
+// written to, for example by editors or when Kubernetes updates a mounted ConfigMap through a symlink.
+// Any change in the directory triggers a refresh, which is cheap and leaves the targets alone if the file did not change.
+func (f *File) watch() (*fsnotify.Watcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "create watcher")
+	}
+
+	if err := w.Add(filepath.Dir(f.path)); err != nil {
+		internal.CloseWithLogOnErr(f.logger, w)
+		return nil, errors.Wrap(err, "watch directory")
+	}
+
+	return w, nil
+}
+
+func (f *File) refresh() error {
+	urls, err := f.read()
+	if err != nil {
+		f.metrics.refreshes.WithLabelValues(discoveryFile, "failure").Inc()
+		return err
+	}
+
+	f.metrics.refreshes.WithLabelValues(discoveryFile, "success").Inc()
+
+	if f.set(urls) {
+		level.Info(f.logger).Log("msg", "targets changed", "file", f.path, "targets", len(f.Targets()))
+	}
+
+	f.metrics.targets.WithLabelValues(discoveryFile).Set(float64(len(f.Targets())))
+
+	return nil
+}
+
+// read parses the target URLs of the file. As JSON is valid YAML, both are parsed the same way.
+func (f *File) read() ([]url.URL, error) {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	var groups []targetGroup
+	if err := yaml.UnmarshalStrict(b, &groups); err != nil {
+		return nil, errors.Wrapf(err, "parse file %s", f.path)
+	}
+
+	var urls []url.URL
+
+	for _, g := range groups {
+		for _, t := range g.Targets {
+			u, err := f.opts.targetURL(t)
+			if err != nil {
+				return nil, err
+			}
+
+			urls = append(urls, u)
+		}
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,189 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// tempDir returns a directory that is removed when the test finishes.
+func tempDir(t *testing.T) string {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "discovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	// The file is replaced rather than written to, like editors and Kubernetes do.
+	if err := ioutil.WriteFile(path+".tmp", []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileRead(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "YAML",
+			content: "- targets: ['127.0.0.1:8080', '127.0.0.1:8081']\n",
+			want:    []string{"http://127.0.0.1:8080/receive", "http://127.0.0.1:8081/receive"},
+		},
+		{
+			name:    "JSON",
+			content: `[{"targets": ["127.0.0.1:8080"], "labels": {"env": "test"}}]`,
+			want:    []string{"http://127.0.0.1:8080/receive"},
+		},
+		{
+			name:    "URLs are kept",
+			content: "- targets: ['https://backend.example.org/api/v1/receive']\n",
+			want:    []string{"https://backend.example.org/api/v1/receive"},
+		},
+		{
+			name:    "groups are merged and deduplicated",
+			content: "- targets: ['127.0.0.1:8081']\n- targets: ['127.0.0.1:8080', '127.0.0.1:8081']\n",
+			want:    []string{"http://127.0.0.1:8080/receive", "http://127.0.0.1:8081/receive"},
+		},
+		{
+			name:    "empty",
+			content: "[]",
+		},
+		{
+			name:    "unknown field",
+			content: "- endpoints: ['127.0.0.1:8080']\n",
+			wantErr: true,
+		},
+		{
+			name:    "target without host",
+			content: "- targets: ['http:///receive']\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(tempDir(t), "targets.yaml")
+			writeFile(t, path, tc.content)
+
+			f, err := NewFile(log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()), path, time.Minute,
+				Options{Scheme: "http", Path: "/receive"})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := addrs(f); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got targets %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFileMissing(t *testing.T) {
+	_, err := NewFile(log.NewNopLogger(), NewMetrics(prometheus.NewRegistry()),
+		filepath.Join(tempDir(t), "targets.yaml"), time.Minute, Options{Scheme: "http"})
+	if err == nil {
+		t.Fatal("got no error, want one")
+	}
+}
+
+func TestFileRunWatchesChanges(t *testing.T) {
+	path := filepath.Join(tempDir(t), "targets.yaml")
+	writeFile(t, path, "- targets: ['127.0.0.1:8080']\n")
+
+	// The interval is long enough that only watching the file picks up changes within the test.
+	m := NewMetrics(prometheus.NewRegistry())
+
+	f, err := NewFile(log.NewNopLogger(), m, path, time.Hour, Options{Scheme: "http", Path: "/receive"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failures := m.refreshes.WithLabelValues(discoveryFile, "failure")
+	kept := f.Targets()[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- f.Run(ctx) }()
+
+	defer func() {
+		cancel()
+
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for _, tc := range []struct {
+		content string
+		want    []string
+		// failures is the minimum number of failed refreshes after the change is picked up.
+		failures float64
+	}{
+		{
+			content: "- targets: ['127.0.0.1:8080', '127.0.0.1:8081']\n",
+			want:    []string{"http://127.0.0.1:8080/receive", "http://127.0.0.1:8081/receive"},
+		},
+		{
+			// Invalid files fail the refresh and keep the previous targets.
+			content:  "- targets: [\n",
+			want:     []string{"http://127.0.0.1:8080/receive", "http://127.0.0.1:8081/receive"},
+			failures: 1,
+		},
+		{
+			content:  "- targets: ['127.0.0.1:8080']\n",
+			want:     []string{"http://127.0.0.1:8080/receive"},
+			failures: 1,
+		},
+	} {
+		var got []string
+
+		// The file is written until the change is picked up, as Run may not be watching it yet.
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			writeFile(t, path, tc.content)
+
+			if got = addrs(f); reflect.DeepEqual(got, tc.want) && testutil.ToFloat64(failures) >= tc.failures {
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("got targets %v, want %v", got, tc.want)
+		}
+
+		if n := testutil.ToFloat64(failures); n < tc.failures {
+			t.Fatalf("got %v failed refreshes, want at least %v", n, tc.failures)
+		}
+	}
+
+	// Targets keep their identity across refreshes, so that pickers can keep track of them.
+	if f.Targets()[0] != kept {
+		t.Error("target of unchanged address was replaced")
+	}
+}
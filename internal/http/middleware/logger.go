@@ -7,6 +7,8 @@ import (
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
 )
 
 // Logger returns a middleware to log HTTP requests.
@@ -20,6 +22,7 @@ func Logger(logger log.Logger) func(next http.Handler) http.Handler {
 
 			keyvals := []interface{}{
 				"request", RequestIDFromContext(r.Context()),
+				"tenant", tenancy.FromContext(r.Context()),
 				"proto", r.Proto,
 				"method", r.Method,
 				"status", ww.Status(),
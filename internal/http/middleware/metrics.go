@@ -2,10 +2,13 @@ package middleware
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
 )
 
 type MetricsMiddleware struct {
@@ -24,7 +27,7 @@ func NewMetricsMiddleware(reg prometheus.Registerer) *MetricsMiddleware {
 				Help:    "Tracks the latencies for HTTP requests.",
 				Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
 			},
-			[]string{"code", "handler", "method"},
+			[]string{"code", "handler", "method", "tenant"},
 		),
 
 		requestSize: promauto.With(reg).NewSummaryVec(
@@ -32,14 +35,14 @@ func NewMetricsMiddleware(reg prometheus.Registerer) *MetricsMiddleware {
 				Name: "http_request_size_bytes",
 				Help: "Tracks the size of HTTP requests.",
 			},
-			[]string{"code", "handler", "method"},
+			[]string{"code", "handler", "method", "tenant"},
 		),
 
 		requestsTotal: promauto.With(reg).NewCounterVec(
 			prometheus.CounterOpts{
 				Name: "http_requests_total",
 				Help: "Tracks the number of HTTP requests.",
-			}, []string{"code", "handler", "method"},
+			}, []string{"code", "handler", "method", "tenant"},
 		),
 
 		responseSize: promauto.With(reg).NewSummaryVec(
@@ -47,7 +50,7 @@ func NewMetricsMiddleware(reg prometheus.Registerer) *MetricsMiddleware {
 				Name: "http_response_size_bytes",
 				Help: "Tracks the size of HTTP responses.",
 			},
-			[]string{"code", "handler", "method"},
+			[]string{"code", "handler", "method", "tenant"},
 		),
 	}
 
@@ -60,22 +63,39 @@ func NewMetricsMiddleware(reg prometheus.Registerer) *MetricsMiddleware {
 // (CounterVec), http_request_duration_seconds (Histogram),
 // http_request_size_bytes (Summary), http_response_size_bytes (Summary). Each
 // has a constant label named "handler" with the provided handlerName as
-// value. http_requests_total is a metric vector partitioned by HTTP method
+// value and a label named "tenant" with the tenant of the request context.
+// http_requests_total is a metric vector partitioned by HTTP method
 // (label name "method") and HTTP status code (label name "code").
 func (ins *MetricsMiddleware) NewHandler(handlerName string) func(next http.Handler) http.Handler {
 	return func(handler http.Handler) http.Handler {
-		return promhttp.InstrumentHandlerDuration(
-			ins.requestDuration.MustCurryWith(prometheus.Labels{"handler": handlerName}),
-			promhttp.InstrumentHandlerRequestSize(
-				ins.requestSize.MustCurryWith(prometheus.Labels{"handler": handlerName}),
-				promhttp.InstrumentHandlerCounter(
-					ins.requestsTotal.MustCurryWith(prometheus.Labels{"handler": handlerName}),
-					promhttp.InstrumentHandlerResponseSize(
-						ins.responseSize.MustCurryWith(prometheus.Labels{"handler": handlerName}),
-						handler,
-					),
+		// Instrumented handlers are created once per tenant, as curried labels are fixed.
+		var handlers sync.Map
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := tenancy.FromContext(r.Context())
+
+			h, ok := handlers.Load(tenant)
+			if !ok {
+				h, _ = handlers.LoadOrStore(tenant, ins.instrument(prometheus.Labels{"handler": handlerName, "tenant": tenant}, handler))
+			}
+
+			h.(http.Handler).ServeHTTP(w, r)
+		})
+	}
+}
+
+func (ins *MetricsMiddleware) instrument(labels prometheus.Labels, handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(
+		ins.requestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerRequestSize(
+			ins.requestSize.MustCurryWith(labels),
+			promhttp.InstrumentHandlerCounter(
+				ins.requestsTotal.MustCurryWith(labels),
+				promhttp.InstrumentHandlerResponseSize(
+					ins.responseSize.MustCurryWith(labels),
+					handler,
 				),
 			),
-		)
-	}
+		),
+	)
 }
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const tenantRejectionKey = ctxKey(1)
+
+// tenantRejection is why the tenant of a request was rejected, and the status it is answered with.
+type tenantRejection struct {
+	code int
+	err  error
+}
+
+// Tenant returns a middleware that reads the tenant from the given header into the request context.
+// Requests without the header are attributed to the default tenant. Requests with an invalid tenant, or of a tenant
+// that is not admitted, are handed on without a tenant, to be rejected by RejectTenant inside the instrumenting
+// middlewares, so that their rejections are counted, traced and logged like any other response.
+// The default tenant is always admitted.
+func Tenant(header, defaultTenant string, admitter *tenancy.Admitter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tenant := r.Header.Get(header)
+			if tenant == "" {
+				tenant = defaultTenant
+			}
+
+			if err := tenancy.Validate(tenant); err != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantRejectionKey,
+					tenantRejection{code: http.StatusBadRequest, err: err})))
+
+				return
+			}
+
+			if tenant != defaultTenant {
+				if err := admitter.Admit(tenant); err != nil {
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantRejectionKey,
+						tenantRejection{code: http.StatusForbidden, err: err})))
+
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(tenancy.NewContext(r.Context(), tenant)))
+		})
+	}
+}
+
+// RejectTenant returns a middleware that answers requests whose tenant was rejected by Tenant,
+// with 400 for invalid tenants and 403 for tenants that are not admitted.
+func RejectTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rej, ok := r.Context().Value(tenantRejectionKey).(tenantRejection); ok {
+			http.Error(w, rej.err.Error(), rej.code)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -6,8 +6,11 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"go.opentelemetry.io/otel/api/correlation"
+	"go.opentelemetry.io/otel/api/kv"
 	"go.opentelemetry.io/otel/api/trace"
 	"go.opentelemetry.io/otel/instrumentation/httptrace"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
 )
 
 // Tracer returns an HTTP handler that injects the given tracer and starts a new server span.
@@ -23,6 +26,10 @@ func Tracer(logger log.Logger, tracer trace.Tracer, name string) func(next http.
 				MultiKV: entries,
 			})))
 
+			if tenant := tenancy.FromContext(ctx); tenant != "" {
+				attrs = append(attrs, kv.String("tenant", tenant))
+			}
+
 			ctx, span := tracer.Start(
 				trace.ContextWithRemoteSpanContext(ctx, spanCtx),
 				name,
@@ -0,0 +1,39 @@
+package http
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Recorder is a http.ResponseWriter that buffers the response of a handler,
+// so that it can be inspected before it is written to the client, or discarded.
+type Recorder struct {
+	Code int
+	Body bytes.Buffer
+
+	header http.Header
+}
+
+// NewRecorder creates a new recorder. Responses without an explicit status code are recorded as 200.
+func NewRecorder() *Recorder {
+	return &Recorder{Code: http.StatusOK, header: http.Header{}}
+}
+
+// Header implements http.ResponseWriter.
+func (r *Recorder) Header() http.Header { return r.header }
+
+// Write implements http.ResponseWriter.
+func (r *Recorder) Write(b []byte) (int, error) { return r.Body.Write(b) }
+
+// WriteHeader implements http.ResponseWriter.
+func (r *Recorder) WriteHeader(code int) { r.Code = code }
+
+// WriteTo writes the buffered response to the given writer.
+func (r *Recorder) WriteTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+
+	w.WriteHeader(r.Code)
+	_, _ = w.Write(r.Body.Bytes())
+}
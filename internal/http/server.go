@@ -10,8 +10,27 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+type options struct {
+	readinessChecks map[string]healthcheck.Check
+}
+
+// Option configures the internal server.
+type Option func(*options)
+
+// WithReadinessCheck adds a check that has to pass for the server to report ready.
+func WithReadinessCheck(name string, check func() error) Option {
+	return func(o *options) {
+		o.readinessChecks[name] = check
+	}
+}
+
 // NewServer creates a new internal server that exposes debug probes.
-func NewServer(reg prometheus.Gatherer, listen, healthcheckURL string) *http.Server {
+func NewServer(reg prometheus.Gatherer, listen, healthcheckURL string, opts ...Option) *http.Server {
+	o := options{readinessChecks: map[string]healthcheck.Check{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	// Internal server to expose introspection APIs.
 	mux := http.NewServeMux()
 
@@ -43,6 +62,10 @@ func NewServer(reg prometheus.Gatherer, listen, healthcheckURL string) *http.Ser
 		),
 	)
 
+	for name, check := range o.readinessChecks {
+		healthchecks.AddReadinessCheck(name, check)
+	}
+
 	return &http.Server{
 		Addr:    listen,
 		Handler: mux,
@@ -19,3 +19,10 @@ func ExhaustCloseWithLogOnErr(logger log.Logger, rc io.ReadCloser) {
 		return
 	}
 }
+
+// CloseWithLogOnErr closes the io.Closer with a log message on error.
+func CloseWithLogOnErr(logger log.Logger, c io.Closer) {
+	if err := c.Close(); err != nil {
+		level.Error(logger).Log("msg", "failed to close", "err", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Package labelpb converts between remote write labels and Prometheus labels.
+package labelpb
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ToLabels converts remote write labels into sorted Prometheus labels.
+func ToLabels(lps []prompb.Label) labels.Labels {
+	lset := make(labels.Labels, 0, len(lps))
+	for _, l := range lps {
+		lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+	}
+
+	sort.Sort(lset)
+
+	return lset
+}
+
+// FromLabels converts Prometheus labels into remote write labels.
+func FromLabels(lset labels.Labels) []prompb.Label {
+	lps := make([]prompb.Label, 0, len(lset))
+	for _, l := range lset {
+		lps = append(lps, prompb.Label{Name: l.Name, Value: l.Value})
+	}
+
+	return lps
+}
@@ -0,0 +1,118 @@
+package limits
+
+import (
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Limits are the ingestion limits of a single tenant. Zero values mean no limit.
+// If an ingestion rate is set without a burst, the burst defaults to the rate, or to the maximum samples per request
+// if that is larger.
+type Limits struct {
+	MaxSamplesPerRequest   int     `yaml:"max_samples_per_request"`
+	MaxSeriesPerRequest    int     `yaml:"max_series_per_request"`
+	MaxLabelNamesPerSeries int     `yaml:"max_label_names_per_series"`
+	MaxLabelNameLength     int     `yaml:"max_label_name_length"`
+	MaxLabelValueLength    int     `yaml:"max_label_value_length"`
+	IngestionRate          float64 `yaml:"ingestion_rate"`
+	IngestionBurst         int     `yaml:"ingestion_burst"`
+}
+
+// Config holds the default limits and the overrides of individual tenants.
+type Config struct {
+	Defaults Limits            `yaml:"defaults"`
+	Tenants  map[string]Limits `yaml:"tenants"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+// Tenant overrides only need to set the limits that differ from the defaults.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw struct {
+		Defaults Limits                   `yaml:"defaults"`
+		Tenants  map[string]yaml.MapSlice `yaml:"tenants"`
+	}
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	c.Defaults = raw.Defaults
+	if err := c.Defaults.complete(); err != nil {
+		return errors.Wrap(err, "default limits")
+	}
+
+	c.Tenants = make(map[string]Limits, len(raw.Tenants))
+
+	for tenant, overrides := range raw.Tenants {
+		b, err := yaml.Marshal(overrides)
+		if err != nil {
+			return errors.Wrapf(err, "marshal limits of tenant %s", tenant)
+		}
+
+		l := raw.Defaults
+		if err := yaml.UnmarshalStrict(b, &l); err != nil {
+			return errors.Wrapf(err, "unmarshal limits of tenant %s", tenant)
+		}
+
+		if err := l.complete(); err != nil {
+			return errors.Wrapf(err, "limits of tenant %s", tenant)
+		}
+
+		c.Tenants[tenant] = l
+	}
+
+	return nil
+}
+
+// complete derives the ingestion burst from the other limits if it is not set, and validates the limits.
+func (l *Limits) complete() error {
+	if l.IngestionRate < 0 || l.IngestionBurst < 0 {
+		return errors.New("ingestion_rate and ingestion_burst must not be negative")
+	}
+
+	if l.IngestionRate == 0 {
+		return nil
+	}
+
+	// A rate limiter without a burst rejects every request.
+	if l.IngestionBurst == 0 {
+		l.IngestionBurst = int(math.Ceil(l.IngestionRate))
+		if l.MaxSamplesPerRequest > l.IngestionBurst {
+			l.IngestionBurst = l.MaxSamplesPerRequest
+		}
+	}
+
+	if l.MaxSamplesPerRequest > l.IngestionBurst {
+		return errors.Errorf("ingestion_burst %d is lower than max_samples_per_request %d, "+
+			"so requests of more samples than the burst would never be accepted", l.IngestionBurst, l.MaxSamplesPerRequest)
+	}
+
+	return nil
+}
+
+// ForTenant returns the limits of the given tenant.
+func (c *Config) ForTenant(tenant string) Limits {
+	if l, ok := c.Tenants[tenant]; ok {
+		return l
+	}
+
+	return c.Defaults
+}
+
+// Load reads the limits configuration from the given file.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read limits file %s", path)
+	}
+
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(b, cfg); err != nil {
+		return nil, errors.Wrapf(err, "parse limits file %s", path)
+	}
+
+	return cfg, nil
+}
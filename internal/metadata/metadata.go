@@ -0,0 +1,101 @@
+package metadata
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// MetricType is the type of a metric family, as sent by Prometheus.
+type MetricType int32
+
+// Metric types in the order of the remote write protocol.
+const (
+	MetricTypeUnknown MetricType = iota
+	MetricTypeCounter
+	MetricTypeGauge
+	MetricTypeHistogram
+	MetricTypeGaugeHistogram
+	MetricTypeSummary
+	MetricTypeInfo
+	MetricTypeStateset
+)
+
+var metricTypeNames = []string{
+	"unknown",
+	"counter",
+	"gauge",
+	"histogram",
+	"gaugehistogram",
+	"summary",
+	"info",
+	"stateset",
+}
+
+// String returns the name of the type as used by the Prometheus metadata API.
+func (t MetricType) String() string {
+	if t < 0 || int(t) >= len(metricTypeNames) {
+		return metricTypeNames[MetricTypeUnknown]
+	}
+
+	return metricTypeNames[t]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t MetricType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// MetricMetadata is the metadata of a single metric family.
+// Field numbers follow the MetricMetadata message of prometheus/prompb/types.proto.
+type MetricMetadata struct {
+	Type             MetricType `protobuf:"varint,1,opt,name=type,proto3"`
+	MetricFamilyName string     `protobuf:"bytes,2,opt,name=metric_family_name,proto3"`
+	Help             string     `protobuf:"bytes,4,opt,name=help,proto3"`
+	Unit             string     `protobuf:"bytes,5,opt,name=unit,proto3"`
+}
+
+// Reset implements proto.Message.
+func (m *MetricMetadata) Reset() { *m = MetricMetadata{} }
+
+// String implements proto.Message.
+func (m *MetricMetadata) String() string { return proto.CompactTextString(m) }
+
+// ProtoMessage implements proto.Message.
+func (*MetricMetadata) ProtoMessage() {}
+
+// writeRequestMetadata holds the metadata field of a remote write request.
+// The vendored remote write protocol predates metadata, so prompb.WriteRequest keeps it in its unrecognized fields.
+type writeRequestMetadata struct {
+	Metadata []*MetricMetadata `protobuf:"bytes,3,rep,name=metadata,proto3"`
+}
+
+func (m *writeRequestMetadata) Reset()         { *m = writeRequestMetadata{} }
+func (m *writeRequestMetadata) String() string { return proto.CompactTextString(m) }
+func (*writeRequestMetadata) ProtoMessage()    {}
+
+// FromWriteRequest decodes the metric metadata carried by the given remote write request.
+func FromWriteRequest(req *prompb.WriteRequest) ([]*MetricMetadata, error) {
+	if len(req.XXX_unrecognized) == 0 {
+		return nil, nil
+	}
+
+	var m writeRequestMetadata
+	if err := proto.Unmarshal(req.XXX_unrecognized, &m); err != nil {
+		return nil, errors.Wrap(err, "decode metadata")
+	}
+
+	return m.Metadata, nil
+}
+
+// ToWriteRequest encodes the given metric metadata into the given remote write request.
+func ToWriteRequest(req *prompb.WriteRequest, mds []*MetricMetadata) error {
+	b, err := proto.Marshal(&writeRequestMetadata{Metadata: mds})
+	if err != nil {
+		return errors.Wrap(err, "encode metadata")
+	}
+
+	req.XXX_unrecognized = append(req.XXX_unrecognized, b...)
+
+	return nil
+}
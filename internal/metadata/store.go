@@ -0,0 +1,141 @@
+package metadata
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/receiver"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// Metadata is the metadata of a metric family as served by the Prometheus metadata API.
+type Metadata struct {
+	Type MetricType `json:"type"`
+	Help string     `json:"help"`
+	Unit string     `json:"unit"`
+}
+
+// Store is an appender that keeps the latest metadata per metric family and tenant,
+// after handing the request to the next appender.
+type Store struct {
+	next   receiver.Appender
+	logger log.Logger
+
+	mtx     sync.RWMutex
+	tenants map[string]map[string]Metadata
+
+	received  *prometheus.CounterVec
+	conflicts *prometheus.CounterVec
+}
+
+// NewStore creates a new appender that stores the metadata of requests appended to the given appender.
+func NewStore(next receiver.Appender, logger log.Logger, reg prometheus.Registerer) *Store {
+	return &Store{
+		next:    next,
+		logger:  logger,
+		tenants: map[string]map[string]Metadata{},
+		received: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_metadata_received_total",
+				Help: "Tracks the number of metric metadata entries received.",
+			},
+			[]string{"tenant"},
+		),
+		conflicts: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_metadata_type_conflicts_total",
+				Help: "Tracks the number of metric metadata entries with a type different to the one stored for the metric family.",
+			},
+			[]string{"tenant"},
+		),
+	}
+}
+
+// Append hands the request to the next appender and stores its metadata if that succeeded.
+// Requests with metadata that cannot be decoded are rejected as bad request.
+func (s *Store) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	mds, err := FromWriteRequest(req)
+	if err != nil {
+		return receiver.BadRequest(err)
+	}
+
+	if err := s.next.Append(ctx, req); err != nil {
+		return err
+	}
+
+	if len(mds) == 0 {
+		return nil
+	}
+
+	tenant := tenancy.FromContext(ctx)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	families, ok := s.tenants[tenant]
+	if !ok {
+		families = map[string]Metadata{}
+		s.tenants[tenant] = families
+	}
+
+	for _, md := range mds {
+		if prev, ok := families[md.MetricFamilyName]; ok && prev.Type != md.Type {
+			s.conflicts.WithLabelValues(tenant).Inc()
+			level.Warn(s.logger).Log(
+				"msg", "metric metadata type conflict",
+				"tenant", tenant,
+				"metric", md.MetricFamilyName,
+				"previous", prev.Type,
+				"current", md.Type,
+			)
+		}
+
+		families[md.MetricFamilyName] = Metadata{Type: md.Type, Help: md.Help, Unit: md.Unit}
+	}
+
+	s.received.WithLabelValues(tenant).Add(float64(len(mds)))
+
+	return nil
+}
+
+// Metadata returns the metadata of the given tenant by metric family name.
+// If metric is not empty, only its metadata is returned. A limit smaller than zero means no limit.
+func (s *Store) Metadata(tenant, metric string, limit int) map[string][]Metadata {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	families := s.tenants[tenant]
+	res := map[string][]Metadata{}
+
+	if metric != "" {
+		if md, ok := families[metric]; ok && limit != 0 {
+			res[metric] = []Metadata{md}
+		}
+
+		return res
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if limit >= 0 && len(res) >= limit {
+			break
+		}
+
+		res[name] = []Metadata{families[name]}
+	}
+
+	return res
+}
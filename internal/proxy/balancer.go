@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Observer is implemented by pickers that take the outcome of requests into account.
+type Observer interface {
+	// Observe is called exactly once for every target returned by Pick, when the request to it finished.
+	// The status code is zero if the request failed with an error.
+	Observe(t *lbtransport.Target, duration time.Duration, code int, err error)
+}
+
+// BalancingTransport is a http.RoundTripper that sends every request to one of the discovered targets, as chosen by a picker.
+// Like lbtransport.Transport, it retries requests that could not be dialed on another target and excludes the target,
+// but it also reports the outcome of every request to pickers implementing Observer.
+type BalancingTransport struct {
+	discovery lbtransport.Discovery
+	picker    lbtransport.TargetPicker
+	observer  Observer
+	parent    http.RoundTripper
+
+	clientMetrics *exthttp.ClientMetrics
+	failures      *prometheus.CounterVec
+}
+
+// NewBalancingTransport creates a new transport balancing requests over the targets of the given discovery.
+func NewBalancingTransport(discovery lbtransport.Discovery, picker lbtransport.TargetPicker, reg prometheus.Registerer) *BalancingTransport {
+	observer, _ := picker.(Observer)
+
+	t := &BalancingTransport{
+		discovery: discovery,
+		picker:    picker,
+		observer:  observer,
+		parent: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: conntrack.NewInstrumentedDialContextFunc(
+				(&net.Dialer{
+					Timeout:   10 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				conntrack.NewDialerMetrics(reg),
+			),
+			MaxIdleConns:          4,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		clientMetrics: exthttp.NewClientMetrics(reg),
+		failures: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_balancer_failed_requests_total",
+				Help: "Tracks the number of requests that could not be sent to any target.",
+			},
+			[]string{"reason"},
+		),
+	}
+
+	for _, reason := range []string{"no_target_resolved", "no_target_available", "canceled"} {
+		t.failures.WithLabelValues(reason)
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *BalancingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+
+		body, err = ioutil.ReadAll(r.Body)
+		if cerr := r.Body.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "read request body")
+		}
+	}
+
+	targets := t.discovery.Targets()
+	if len(targets) == 0 {
+		t.failures.WithLabelValues("no_target_resolved").Inc()
+		return nil, errors.New("lb: no target was resolved")
+	}
+
+	for r.Context().Err() == nil {
+		target := t.picker.Pick(targets)
+		if target == nil {
+			t.failures.WithLabelValues("no_target_available").Inc()
+			return nil, errors.New("lb: no target is available")
+		}
+
+		// Override the URL, so that the parent transport dials the target and uses its connection pool.
+		req := r.Clone(r.Context())
+		addr := target.DialAddr
+		req.URL = &addr
+
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+		}
+
+		start := time.Now()
+		// NOTE: Labelling by target risks high cardinality if targets change frequently.
+		res, err := exthttp.NewMetricTripperware(t.clientMetrics, target.DialAddr.String(), t.parent).RoundTrip(req)
+
+		if t.observer != nil {
+			var code int
+			if res != nil {
+				code = res.StatusCode
+			}
+
+			t.observer.Observe(target, time.Since(start), code, err)
+		}
+
+		if err == nil || !isDialError(err) {
+			return res, err
+		}
+
+		// Retry without this target.
+		t.picker.ExcludeTarget(target)
+	}
+
+	t.failures.WithLabelValues("canceled").Inc()
+
+	return nil, r.Context().Err()
+}
+
+func isDialError(err error) bool {
+	var e *net.OpError
+	return errors.As(err, &e) && e.Op == "dial"
+}
@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+
+	internalhttp "github.com/kakkoyun/observable-remote-write/internal/http"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const (
+	batchPassthrough = "passthrough"
+	batchSplit       = "split"
+	batchCoalesced   = "coalesced"
+)
+
+// perRequestHeaders are the headers that identify a single client request, like its ID and trace context.
+// They are not forwarded with coalesced requests, and requests are coalesced regardless of them.
+var perRequestHeaders = []string{"Content-Length", "X-Request-Id", "Traceparent", "Tracestate", "Otcorrelations", "Uber-Trace-Id"}
+
+// BatchOptions configures a Batcher.
+type BatchOptions struct {
+	// MaxSeries is the maximum number of series of a forwarded request. No limit applies if 0.
+	MaxSeries int
+	// MaxBytes is the maximum uncompressed size of a forwarded request. No limit applies if 0.
+	MaxBytes int
+	// FlushInterval is the time small requests are held back to be coalesced with others. Requests are not coalesced if 0.
+	FlushInterval time.Duration
+	// GroupLabels are the names of labels, like the cluster and replica labels of HA pairs, that requests are only
+	// coalesced with requests of equal values of. The values are taken from the first series of a request, as the
+	// series of a request of a Prometheus server share its external labels.
+	GroupLabels []string
+}
+
+// Batcher is a http.Handler that reshapes requests before handing them to the next handler.
+// Requests exceeding the maximum number of series or size are split into several requests, which are handed on
+// concurrently; the client receives the most severe of their responses.
+// Other requests of the same tenant, values of the group labels and headers are coalesced for the flush interval,
+// or until the batch reaches the maximum, and handed on as one request; every client of the batch receives its
+// response, including errors. Requests of a rejected batch are not handed on again, as the valid series of a
+// partially rejected batch are already appended.
+type Batcher struct {
+	next   http.Handler
+	logger log.Logger
+	tracer trace.Tracer
+	opts   BatchOptions
+
+	mtx     sync.Mutex
+	pending map[string]*batch
+
+	series    *prometheus.HistogramVec
+	bytes     *prometheus.HistogramVec
+	requests  prometheus.Histogram
+	splitReqs prometheus.Counter
+}
+
+// batch is a set of requests that is handed on as one.
+type batch struct {
+	tenant   string
+	path     string
+	encoding string
+	header   http.Header
+
+	reqs    []*prompb.WriteRequest
+	clients []*http.Request
+	waiters []chan *internalhttp.Recorder
+	series  int
+	bytes   int
+	timer   *time.Timer
+}
+
+// NewBatcher creates a new handler splitting and coalescing requests before handing them to the given handler.
+func NewBatcher(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, next http.Handler, opts BatchOptions) *Batcher {
+	return &Batcher{
+		next:    next,
+		logger:  logger,
+		tracer:  tracer,
+		opts:    opts,
+		pending: map[string]*batch{},
+		series: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_batch_forwarded_series",
+				Help:    "Tracks the number of series of forwarded requests, by whether they were split, coalesced or passed through.",
+				Buckets: prometheus.ExponentialBuckets(1, 4, 9),
+			},
+			[]string{"kind"},
+		),
+		bytes: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_batch_forwarded_bytes",
+				Help:    "Tracks the uncompressed size of forwarded requests, by whether they were split, coalesced or passed through.",
+				Buckets: prometheus.ExponentialBuckets(256, 4, 9),
+			},
+			[]string{"kind"},
+		),
+		requests: promauto.With(reg).NewHistogram(
+			prometheus.HistogramOpts{
+				Name:    "proxy_batch_coalesced_requests",
+				Help:    "Tracks the number of client requests coalesced into a forwarded request.",
+				Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+			},
+		),
+		splitReqs: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_batch_split_requests_total",
+				Help: "Tracks the number of client requests that were split into several forwarded requests.",
+			},
+		),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (b *Batcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enc, err := requestEncoding(r)
+	if err != nil {
+		decodeFailed(w, err)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	wreq, err := decodeBody(enc, compressed)
+	if err != nil {
+		level.Debug(b.logger).Log("msg", "failed to decode request", "err", err)
+		decodeFailed(w, err)
+
+		return
+	}
+
+	series, size := len(wreq.Timeseries), wreq.Size()
+
+	switch {
+	case b.exceeds(series, size):
+		b.split(w, r, enc, wreq)
+	case b.opts.FlushInterval > 0:
+		b.coalesce(w, r, enc, wreq, size)
+	default:
+		b.observe(batchPassthrough, series, size)
+		replaceBody(r, compressed)
+		b.next.ServeHTTP(w, r)
+	}
+}
+
+// exceeds returns whether a request of the given number of series and size exceeds the maximum.
+func (b *Batcher) exceeds(series, size int) bool {
+	return (b.opts.MaxSeries > 0 && series > b.opts.MaxSeries) || (b.opts.MaxBytes > 0 && size > b.opts.MaxBytes)
+}
+
+func (b *Batcher) observe(kind string, series, size int) {
+	b.series.WithLabelValues(kind).Observe(float64(series))
+	b.bytes.WithLabelValues(kind).Observe(float64(size))
+}
+
+// split hands the parts of the given request on concurrently and answers with the most severe of their responses.
+// Parts that succeeded are not rolled back if others fail, so retries of the client may resend them.
+func (b *Batcher) split(w http.ResponseWriter, r *http.Request, enc string, wreq *prompb.WriteRequest) {
+	parts := splitRequest(wreq, b.opts.MaxSeries, b.opts.MaxBytes)
+
+	ctx, span := b.tracer.Start(r.Context(), "split", trace.WithAttributes(
+		kv.Int("series", len(wreq.Timeseries)),
+		kv.Int("parts", len(parts)),
+	))
+	defer span.End()
+
+	b.splitReqs.Inc()
+
+	reqs := make([]*http.Request, 0, len(parts))
+
+	for _, part := range parts {
+		body, err := encodeRequest(enc, part)
+		if err != nil {
+			span.RecordError(ctx, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		b.observe(batchSplit, len(part.Timeseries), part.Size())
+
+		req := r.Clone(ctx)
+		replaceBody(req, body)
+		reqs = append(reqs, req)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		recs = make([]*internalhttp.Recorder, len(reqs))
+	)
+
+	for i, req := range reqs {
+		recs[i] = internalhttp.NewRecorder()
+
+		wg.Add(1)
+
+		go func(rec *internalhttp.Recorder, req *http.Request) {
+			defer wg.Done()
+			b.next.ServeHTTP(rec, req)
+		}(recs[i], req)
+	}
+
+	wg.Wait()
+
+	worst := recs[0]
+	for _, rec := range recs[1:] {
+		if severity(rec.Code) > severity(worst.Code) {
+			worst = rec
+		}
+	}
+
+	worst.WriteTo(w)
+}
+
+// coalesce adds the given request to the pending batch of its tenant and group and waits for the response of the batch.
+// Requests are only coalesced with requests of the same path and headers, apart from the per request ones, which the
+// batch is handed on with.
+func (b *Batcher) coalesce(w http.ResponseWriter, r *http.Request, enc string, wreq *prompb.WriteRequest, size int) {
+	var (
+		tenant = tenancy.FromContext(r.Context())
+		header = r.Header.Clone()
+		done   = make(chan *internalhttp.Recorder, 1)
+	)
+
+	for _, name := range perRequestHeaders {
+		header.Del(name)
+	}
+
+	key := tenant + "\xff" + r.URL.Path + "\xff" + headerKey(header) + "\xff" + b.group(wreq)
+
+	b.mtx.Lock()
+
+	bt, ok := b.pending[key]
+	if ok && b.exceeds(bt.series+len(wreq.Timeseries), bt.bytes+size) {
+		b.detach(key, bt)
+		go b.flush(bt)
+
+		ok = false
+	}
+
+	if !ok {
+		bt = &batch{tenant: tenant, path: r.URL.Path, encoding: enc, header: header}
+		bt.timer = time.AfterFunc(b.opts.FlushInterval, func() {
+			b.mtx.Lock()
+			detached := b.detach(key, bt)
+			b.mtx.Unlock()
+
+			if detached {
+				b.flush(bt)
+			}
+		})
+		b.pending[key] = bt
+	}
+
+	bt.reqs = append(bt.reqs, wreq)
+	bt.clients = append(bt.clients, r)
+	bt.waiters = append(bt.waiters, done)
+	bt.series += len(wreq.Timeseries)
+	bt.bytes += size
+
+	b.mtx.Unlock()
+
+	select {
+	case rec := <-done:
+		rec.WriteTo(w)
+	case <-r.Context().Done():
+		// The batch is still handed on, but the client is gone.
+	}
+}
+
+// group returns the values of the group labels of the given request.
+// Downstream, like in the HA tracker, the series of a request are assumed to share them.
+func (b *Batcher) group(wreq *prompb.WriteRequest) string {
+	if len(b.opts.GroupLabels) == 0 || len(wreq.Timeseries) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	for _, name := range b.opts.GroupLabels {
+		for _, l := range wreq.Timeseries[0].Labels {
+			if l.Name == name {
+				sb.WriteString(l.Value)
+				break
+			}
+		}
+
+		sb.WriteByte('\xff')
+	}
+
+	return sb.String()
+}
+
+// headerKey returns a canonical representation of the given headers.
+func headerKey(h http.Header) string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var sb strings.Builder
+
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		sb.WriteString(strings.Join(h[name], "\xfe"))
+		sb.WriteByte('\xff')
+	}
+
+	return sb.String()
+}
+
+// detach removes the given batch from the pending ones, if it is still pending. It must be called with the lock held.
+func (b *Batcher) detach(key string, bt *batch) bool {
+	if b.pending[key] != bt {
+		return false
+	}
+
+	delete(b.pending, key)
+	bt.timer.Stop()
+
+	return true
+}
+
+// flush hands the given batch on and delivers the response to all of its clients.
+// The batch is not canceled with its clients, but it is linked to their traces, carries their request IDs and
+// ends with the latest of their deadlines, if all of them have one.
+func (b *Batcher) flush(bt *batch) {
+	var (
+		ids      = make([]string, 0, len(bt.clients))
+		opts     = make([]trace.StartOption, 0, len(bt.clients)+1)
+		deadline time.Time
+		bounded  = true
+	)
+
+	for _, r := range bt.clients {
+		ids = append(ids, r.Header.Get("X-Request-ID"))
+		opts = append(opts, trace.LinkedTo(trace.SpanFromContext(r.Context()).SpanContext()))
+
+		d, ok := r.Context().Deadline()
+		if d.After(deadline) {
+			deadline = d
+		}
+
+		bounded = bounded && ok
+	}
+
+	ctx, cancel := tenancy.NewContext(context.Background(), bt.tenant), context.CancelFunc(func() {})
+	if bounded {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	defer cancel()
+
+	ctx, span := b.tracer.Start(ctx, "coalesce", append(opts, trace.WithAttributes(
+		kv.Int("requests", len(bt.reqs)),
+		kv.Int("series", bt.series),
+		kv.String("request_ids", strings.Join(ids, ",")),
+	))...)
+	defer span.End()
+
+	level.Debug(b.logger).Log("msg", "handing batch on", "requests", len(bt.reqs), "series", bt.series,
+		"request_ids", strings.Join(ids, ","))
+
+	b.requests.Observe(float64(len(bt.reqs)))
+	b.observe(batchCoalesced, bt.series, bt.bytes)
+
+	var combined prompb.WriteRequest
+
+	for _, req := range bt.reqs {
+		combined.Timeseries = append(combined.Timeseries, req.Timeseries...)
+		// Fields unknown to this version of the protocol, like metadata, are repeated fields and can be concatenated.
+		combined.XXX_unrecognized = append(combined.XXX_unrecognized, req.XXX_unrecognized...)
+	}
+
+	rec := b.send(ctx, bt, &combined)
+
+	for _, done := range bt.waiters {
+		done <- rec
+	}
+}
+
+// send hands the given request of a batch on and records the response.
+func (b *Batcher) send(ctx context.Context, bt *batch, wreq *prompb.WriteRequest) *internalhttp.Recorder {
+	rec := internalhttp.NewRecorder()
+
+	body, err := encodeRequest(bt.encoding, wreq)
+	if err != nil {
+		http.Error(rec, err.Error(), http.StatusInternalServerError)
+		return rec
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, bt.path, nil)
+	if err != nil {
+		http.Error(rec, err.Error(), http.StatusInternalServerError)
+		return rec
+	}
+
+	req.Header = bt.header.Clone()
+	replaceBody(req, body)
+
+	b.next.ServeHTTP(rec, req)
+
+	return rec
+}
+
+// splitRequest splits the given request into requests of at most the given number of series and size.
+// Metadata is sent with the first request.
+func splitRequest(wreq *prompb.WriteRequest, maxSeries, maxBytes int) []*prompb.WriteRequest {
+	var (
+		parts []*prompb.WriteRequest
+		cur   = &prompb.WriteRequest{XXX_unrecognized: wreq.XXX_unrecognized}
+		size  = len(wreq.XXX_unrecognized)
+	)
+
+	for _, ts := range wreq.Timeseries {
+		s := ts.Size()
+
+		if len(cur.Timeseries) > 0 &&
+			((maxSeries > 0 && len(cur.Timeseries)+1 > maxSeries) || (maxBytes > 0 && size+s > maxBytes)) {
+			parts = append(parts, cur)
+			cur, size = &prompb.WriteRequest{}, 0
+		}
+
+		cur.Timeseries = append(cur.Timeseries, ts)
+		size += s
+	}
+
+	return append(parts, cur)
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// windowBuckets is the number of buckets the sliding window of a circuit is split into.
+const windowBuckets = 10
+
+type breakerState int
+
+const (
+	stateClosed breakerState = iota
+	stateHalfOpen
+	stateOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateHalfOpen:
+		return "half-open"
+	case stateOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerOptions configures a CircuitBreaker.
+type BreakerOptions struct {
+	// Window is the duration of the sliding window error and latency rates are computed over.
+	Window time.Duration
+	// MinRequests is the number of requests in the window below which a circuit does not open.
+	MinRequests int
+	// FailureRate is the rate of failed requests in the window at which a circuit opens.
+	FailureRate float64
+	// SlowThreshold is the duration above which requests are considered slow.
+	SlowThreshold time.Duration
+	// SlowRate is the rate of slow requests in the window at which a circuit opens.
+	SlowRate float64
+	// OpenDuration is the time a circuit stays open before letting probe requests through.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of probe requests that have to succeed for a half-open circuit to close.
+	HalfOpenProbes int
+}
+
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+	slow     int
+}
+
+// circuit is the circuit of a single target.
+type circuit struct {
+	state    breakerState
+	openedAt time.Time
+	buckets  [windowBuckets]bucket
+
+	probesInFlight int
+	probesPassed   int
+}
+
+// CircuitBreaker is a picker that wraps another one and stops picking targets whose circuit is open.
+// A circuit opens when the rate of failed or slow requests to its target over a sliding window exceeds the configured rates.
+// After a while, it lets a few probe requests through; if they succeed it closes again, otherwise it stays open.
+// Failed requests are the ones that failed with an error or a server error.
+type CircuitBreaker struct {
+	next   lbtransport.TargetPicker
+	logger log.Logger
+	tracer trace.Tracer
+	opts   BreakerOptions
+
+	mtx      sync.Mutex
+	circuits map[string]*circuit
+
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+// NewCircuitBreaker creates a new circuit breaker in front of the given picker.
+func NewCircuitBreaker(
+	next lbtransport.TargetPicker,
+	logger log.Logger,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+	opts BreakerOptions,
+) *CircuitBreaker {
+	if opts.HalfOpenProbes < 1 {
+		opts.HalfOpenProbes = 1
+	}
+
+	return &CircuitBreaker{
+		next:     next,
+		logger:   logger,
+		tracer:   tracer,
+		opts:     opts,
+		circuits: map[string]*circuit{},
+		state: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_circuit_breaker_state",
+				Help: "The state of the circuit of a target. 0 is closed, 1 is half-open and 2 is open.",
+			},
+			[]string{"target"},
+		),
+		transitions: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_circuit_breaker_transitions_total",
+				Help: "Tracks the number of transitions of circuits into a state.",
+			},
+			[]string{"target", "state"},
+		),
+	}
+}
+
+// Pick implements lbtransport.TargetPicker. It hands the targets whose circuit lets requests through to the wrapped picker.
+func (b *CircuitBreaker) Pick(targets []*lbtransport.Target) *lbtransport.Target {
+	now := time.Now()
+	allowed := make([]*lbtransport.Target, 0, len(targets))
+
+	b.mtx.Lock()
+
+	for _, t := range targets {
+		c := b.circuit(t)
+
+		if c.state == stateOpen && now.Sub(c.openedAt) >= b.opts.OpenDuration {
+			b.transition(t, c, stateHalfOpen, now)
+		}
+
+		switch c.state {
+		case stateClosed:
+			allowed = append(allowed, t)
+		case stateHalfOpen:
+			if c.probesInFlight+c.probesPassed < b.opts.HalfOpenProbes {
+				allowed = append(allowed, t)
+			}
+		}
+	}
+
+	b.mtx.Unlock()
+
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	picked := b.next.Pick(allowed)
+	if picked == nil {
+		return nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if c := b.circuit(picked); c.state == stateHalfOpen {
+		c.probesInFlight++
+	}
+
+	return picked
+}
+
+// ExcludeTarget implements lbtransport.TargetPicker.
+func (b *CircuitBreaker) ExcludeTarget(t *lbtransport.Target) {
+	b.next.ExcludeTarget(t)
+}
+
+// Observe implements Observer. It records the outcome of the request in the circuit of the target
+// and hands it to the wrapped picker if that observes requests too.
+func (b *CircuitBreaker) Observe(t *lbtransport.Target, d time.Duration, code int, err error) {
+	if o, ok := b.next.(Observer); ok {
+		o.Observe(t, d, code, err)
+	}
+
+	var (
+		now    = time.Now()
+		failed = err != nil || code/100 == 5
+		slow   = b.opts.SlowThreshold > 0 && d > b.opts.SlowThreshold
+	)
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	c := b.circuit(t)
+
+	switch c.state {
+	case stateHalfOpen:
+		if c.probesInFlight > 0 {
+			c.probesInFlight--
+		}
+
+		if failed || slow {
+			b.transition(t, c, stateOpen, now)
+			return
+		}
+
+		if c.probesPassed++; c.probesPassed >= b.opts.HalfOpenProbes {
+			b.transition(t, c, stateClosed, now)
+		}
+	case stateClosed:
+		bk := b.bucket(c, now)
+		bk.requests++
+
+		if failed {
+			bk.failures++
+		}
+
+		if slow {
+			bk.slow++
+		}
+
+		requests, failures, slows := b.totals(c, now)
+		if requests < b.opts.MinRequests {
+			return
+		}
+
+		if (b.opts.FailureRate > 0 && float64(failures)/float64(requests) >= b.opts.FailureRate) ||
+			(b.opts.SlowRate > 0 && float64(slows)/float64(requests) >= b.opts.SlowRate) {
+			b.transition(t, c, stateOpen, now)
+		}
+	}
+}
+
+// circuit returns the circuit of the given target, creating a closed one if needed. It must be called with the lock held.
+func (b *CircuitBreaker) circuit(t *lbtransport.Target) *circuit {
+	addr := t.DialAddr.String()
+
+	c, ok := b.circuits[addr]
+	if !ok {
+		c = &circuit{}
+		b.circuits[addr] = c
+		b.state.WithLabelValues(addr).Set(float64(stateClosed))
+	}
+
+	return c
+}
+
+// bucket returns the bucket of the window the given time falls into, resetting it if it is outdated.
+func (b *CircuitBreaker) bucket(c *circuit, now time.Time) *bucket {
+	width := b.opts.Window / windowBuckets
+	start := now.Truncate(width)
+	bk := &c.buckets[(start.UnixNano()/int64(width))%windowBuckets]
+
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+
+	return bk
+}
+
+// totals sums up the buckets within the window.
+func (b *CircuitBreaker) totals(c *circuit, now time.Time) (requests, failures, slow int) {
+	for _, bk := range c.buckets {
+		if now.Sub(bk.start) >= b.opts.Window {
+			continue
+		}
+
+		requests += bk.requests
+		failures += bk.failures
+		slow += bk.slow
+	}
+
+	return requests, failures, slow
+}
+
+// transition moves the circuit of the given target into the given state, logging and tracing it.
+// It must be called with the lock held.
+func (b *CircuitBreaker) transition(t *lbtransport.Target, c *circuit, to breakerState, now time.Time) {
+	from := c.state
+	addr := t.DialAddr.String()
+
+	c.state = to
+	c.probesInFlight = 0
+	c.probesPassed = 0
+
+	switch to {
+	case stateOpen:
+		c.openedAt = now
+	case stateClosed:
+		c.buckets = [windowBuckets]bucket{}
+	}
+
+	b.state.WithLabelValues(addr).Set(float64(to))
+	b.transitions.WithLabelValues(addr, to.String()).Inc()
+
+	level.Warn(b.logger).Log("msg", "circuit breaker state changed", "target", addr, "from", from, "to", to)
+
+	_, span := b.tracer.Start(context.Background(), "circuit_breaker_transition", trace.WithAttributes(
+		kv.String("target", addr),
+		kv.String("from", from.String()),
+		kv.String("to", to.String()),
+	))
+	span.End()
+}
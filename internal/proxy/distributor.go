@@ -0,0 +1,501 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/gogo/protobuf/proto"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+
+	"github.com/kakkoyun/observable-remote-write/internal"
+	"github.com/kakkoyun/observable-remote-write/internal/compression"
+	"github.com/kakkoyun/observable-remote-write/internal/http/middleware"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// forwardedHeaders are the headers of the incoming request that are copied to every sub-request.
+var forwardedHeaders = []string{"User-Agent", "X-Prometheus-Remote-Write-Version"}
+
+// DistributorOptions configures a Distributor.
+type DistributorOptions struct {
+	// TenantHeader is the header the tenant of a request is forwarded with.
+	TenantHeader string
+	// ShardSeries splits requests by series on a consistent hash ring.
+	// Otherwise whole requests are forwarded to targets in turn.
+	ShardSeries bool
+	// VirtualNodes is the number of virtual nodes each target owns on the hash ring.
+	VirtualNodes int
+	// IncludeTenant makes the tenant part of the series hash, so that tenants are sharded independently.
+	IncludeTenant bool
+	// ExcludeLabels are left out of the series hash. Excluding the replica label of HA pairs writes the copies of a
+	// series of all replicas to the same targets, which deduplicate them.
+	ExcludeLabels []string
+	// ReplicationFactor is the number of distinct targets every series is written to.
+	ReplicationFactor int
+	// Quorum is the number of targets that have to acknowledge a series for the request to succeed.
+	// Zero means a majority of the replication factor.
+	Quorum int
+}
+
+// Distributor is an HTTP handler that fans remote write requests out to its targets.
+// When sharding, requests are split by series and every series is written to the targets owning it on a consistent hash ring,
+// so that every target receives a stable shard of series. Every series is replicated to the configured number of distinct targets.
+type Distributor struct {
+	logger    log.Logger
+	tracer    trace.Tracer
+	discovery lbtransport.Discovery
+	client    *http.Client
+	opts      DistributorOptions
+
+	mtx     sync.Mutex
+	ringKey string
+	ring    *Hashring
+	next    int
+
+	forwardedRequests *prometheus.CounterVec
+	forwardedSeries   *prometheus.CounterVec
+	quorumMissed      prometheus.Counter
+}
+
+// NewDistributor creates a new distributor sending sub-requests to the targets of the given discovery with the given client.
+func NewDistributor(
+	logger log.Logger,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+	discovery lbtransport.Discovery,
+	client *http.Client,
+	opts DistributorOptions,
+) *Distributor {
+	if opts.ReplicationFactor < 1 {
+		opts.ReplicationFactor = 1
+	}
+
+	if opts.Quorum < 1 {
+		opts.Quorum = opts.ReplicationFactor/2 + 1
+	}
+
+	return &Distributor{
+		logger:    logger,
+		tracer:    tracer,
+		discovery: discovery,
+		client:    client,
+		opts:      opts,
+		forwardedRequests: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_forwarded_requests_total",
+				Help: "Tracks the number of sub-requests forwarded to targets.",
+			},
+			[]string{"target", "code"},
+		),
+		forwardedSeries: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_forwarded_series_total",
+				Help: "Tracks the number of series forwarded to targets.",
+			},
+			[]string{"target"},
+		),
+		quorumMissed: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_quorum_missed_requests_total",
+				Help: "Tracks the number of requests failed because a series was not acknowledged by a quorum of targets.",
+			},
+		),
+	}
+}
+
+// result is the outcome of forwarding a sub-request to a target.
+type result struct {
+	code int
+	err  error
+}
+
+// ServeHTTP decodes the remote write request, splits it by target and forwards the sub-requests concurrently.
+// The request succeeds if every series was acknowledged by a quorum of its targets.
+// Otherwise it fails with the most severe status of the failed sub-requests, so that Prometheus retries it as a whole.
+func (d *Distributor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, span := d.tracer.Start(r.Context(), "distribute")
+	defer span.End()
+
+	defer internal.ExhaustCloseWithLogOnErr(d.logger, r.Body)
+
+	req, enc, err := decodeRequest(r)
+	if err != nil {
+		level.Warn(d.logger).Log("msg", "decode request", "err", err)
+		decodeFailed(w, err)
+
+		return
+	}
+
+	targets := d.discovery.Targets()
+	if len(targets) == 0 {
+		level.Warn(d.logger).Log("msg", "no targets available")
+		http.Error(w, "no targets available", http.StatusServiceUnavailable)
+
+		return
+	}
+
+	subRequests, replicas := d.split(ctx, targets, req)
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		results = make(map[*lbtransport.Target]result, len(subRequests))
+	)
+
+	for t, sub := range subRequests {
+		wg.Add(1)
+
+		go func(t *lbtransport.Target, sub *prompb.WriteRequest) {
+			defer wg.Done()
+
+			code, err := d.forward(ctx, r.Header, enc, t, sub)
+			if err != nil {
+				level.Warn(d.logger).Log("msg", "forward sub-request", "target", t.DialAddr.String(), "code", code, "err", err)
+			}
+
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			results[t] = result{code: code, err: err}
+		}(t, sub)
+	}
+
+	wg.Wait()
+
+	if code, err := d.quorum(replicas, results); err != nil {
+		d.quorumMissed.Inc()
+		level.Warn(d.logger).Log("msg", "quorum not reached", "code", code, "err", err)
+		http.Error(w, err.Error(), code)
+	}
+}
+
+// quorum checks that every series was acknowledged by a quorum of its targets.
+// If not, it returns the most severe status and the errors of the targets that failed.
+func (d *Distributor) quorum(replicas [][]*lbtransport.Target, results map[*lbtransport.Target]result) (int, error) {
+	var (
+		code   = http.StatusOK
+		failed = map[*lbtransport.Target]struct{}{}
+	)
+
+	for _, targets := range replicas {
+		var acks int
+
+		for _, t := range targets {
+			if results[t].err == nil {
+				acks++
+			}
+		}
+
+		if acks >= d.opts.Quorum {
+			continue
+		}
+
+		for _, t := range targets {
+			res := results[t]
+			if res.err == nil {
+				continue
+			}
+
+			if severity(res.code) > severity(code) {
+				code = res.code
+			}
+
+			failed[t] = struct{}{}
+		}
+
+		if code == http.StatusOK {
+			// Not a single replica failed, there are just too few targets to reach the quorum.
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	if code == http.StatusOK {
+		return code, nil
+	}
+
+	msgs := make([]string, 0, len(failed))
+	for t := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", t.DialAddr.String(), results[t].err))
+	}
+
+	sort.Strings(msgs)
+
+	if len(msgs) == 0 {
+		msgs = append(msgs, fmt.Sprintf("not enough targets to reach a quorum of %d", d.opts.Quorum))
+	}
+
+	return code, errors.New(strings.Join(msgs, "; "))
+}
+
+// split groups the series of the request by the targets they are written to.
+// It also returns the targets of every series, in the order of the request.
+// Every sub-request carries the unrecognized fields of the request, so that metadata reaches all targets.
+func (d *Distributor) split(
+	ctx context.Context,
+	targets []*lbtransport.Target,
+	req *prompb.WriteRequest,
+) (map[*lbtransport.Target]*prompb.WriteRequest, [][]*lbtransport.Target) {
+	var (
+		subRequests = map[*lbtransport.Target]*prompb.WriteRequest{}
+		replicas    = make([][]*lbtransport.Target, 0, len(req.Timeseries))
+	)
+
+	add := func(t *lbtransport.Target, ts ...prompb.TimeSeries) {
+		sub, ok := subRequests[t]
+		if !ok {
+			sub = &prompb.WriteRequest{XXX_unrecognized: req.XXX_unrecognized}
+			subRequests[t] = sub
+		}
+
+		sub.Timeseries = append(sub.Timeseries, ts...)
+	}
+
+	if len(req.Timeseries) == 0 {
+		// Requests without series still have to deliver their metadata.
+		if len(req.XXX_unrecognized) > 0 {
+			for _, t := range targets {
+				add(t)
+			}
+
+			replicas = append(replicas, targets)
+		}
+
+		return subRequests, replicas
+	}
+
+	if !d.opts.ShardSeries {
+		ts := d.rotate(targets)
+		for _, t := range ts {
+			add(t, req.Timeseries...)
+		}
+
+		for range req.Timeseries {
+			replicas = append(replicas, ts)
+		}
+
+		return subRequests, replicas
+	}
+
+	ring := d.hashring(targets)
+
+	var tenant string
+	if d.opts.IncludeTenant {
+		tenant = tenancy.FromContext(ctx)
+	}
+
+	for _, series := range req.Timeseries {
+		ts := ring.GetN(hashSeries(tenant, series.Labels, d.opts.ExcludeLabels), d.opts.ReplicationFactor)
+		for _, t := range ts {
+			add(t, series)
+		}
+
+		replicas = append(replicas, ts)
+	}
+
+	return subRequests, replicas
+}
+
+// rotate returns as many distinct targets as the replication factor asks for, starting with the next one in turn.
+func (d *Distributor) rotate(targets []*lbtransport.Target) []*lbtransport.Target {
+	n := d.opts.ReplicationFactor
+	if n > len(targets) {
+		n = len(targets)
+	}
+
+	d.mtx.Lock()
+	first := d.next % len(targets)
+	d.next = first + 1
+	d.mtx.Unlock()
+
+	res := make([]*lbtransport.Target, 0, n)
+	for i := 0; i < n; i++ {
+		res = append(res, targets[(first+i)%len(targets)])
+	}
+
+	return res
+}
+
+// hashring returns the hash ring of the given targets, rebuilding it only if the targets changed.
+func (d *Distributor) hashring(targets []*lbtransport.Target) *Hashring {
+	addrs := make([]string, 0, len(targets))
+	for _, t := range targets {
+		addrs = append(addrs, t.DialAddr.String())
+	}
+
+	key := strings.Join(addrs, ",")
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.ring == nil || d.ringKey != key {
+		d.ring = NewHashring(targets, d.opts.VirtualNodes)
+		d.ringKey = key
+	}
+
+	return d.ring
+}
+
+// forward sends the given sub-request to the given target in the given content encoding,
+// returning the status code it was answered with. Transport errors are reported as 502.
+func (d *Distributor) forward(
+	ctx context.Context,
+	header http.Header,
+	enc string,
+	t *lbtransport.Target,
+	sub *prompb.WriteRequest,
+) (int, error) {
+	addr := t.DialAddr.String()
+
+	ctx, span := d.tracer.Start(ctx, "forward", trace.WithAttributes(
+		kv.String("target", addr),
+		kv.Int("series", len(sub.Timeseries)),
+	))
+	defer span.End()
+
+	body, err := encodeRequest(enc, sub)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, errors.Wrap(err, "new request")
+	}
+
+	for _, h := range forwardedHeaders {
+		if v := header.Get(h); v != "" {
+			r.Header.Set(h, v)
+		}
+	}
+
+	r.Header.Set("Content-Encoding", enc)
+	r.Header.Set("Content-Type", "application/x-protobuf")
+	r.Header.Set(d.opts.TenantHeader, tenancy.FromContext(ctx))
+
+	if rid := middleware.RequestIDFromContext(ctx); rid != "" {
+		r.Header.Set("X-Request-ID", rid)
+	}
+
+	res, err := d.client.Do(r)
+	if err != nil {
+		d.forwardedRequests.WithLabelValues(addr, "error").Inc()
+		return http.StatusBadGateway, errors.Wrap(err, "send request")
+	}
+
+	defer internal.ExhaustCloseWithLogOnErr(d.logger, res.Body)
+
+	d.forwardedRequests.WithLabelValues(addr, strconv.Itoa(res.StatusCode)).Inc()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, errors.Errorf("server returned HTTP status %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+
+	d.forwardedSeries.WithLabelValues(addr).Add(float64(len(sub.Timeseries)))
+
+	return res.StatusCode, nil
+}
+
+// severity orders status codes by how a failed request has to be answered:
+// retryable server errors win over rate limiting, which wins over client errors.
+func severity(code int) int {
+	switch {
+	case code/100 == 2:
+		return 0
+	case code == http.StatusTooManyRequests:
+		return 2
+	case code/100 == 4:
+		return 1
+	default:
+		return 3
+	}
+}
+
+// requestEncoding returns the content encoding of the body of the given HTTP request.
+func requestEncoding(r *http.Request) (string, error) {
+	return compression.Parse(r.Header.Get("Content-Encoding"))
+}
+
+// decodeRequest reads and decodes the remote write request of the given HTTP request, returning its content encoding.
+func decodeRequest(r *http.Request) (*prompb.WriteRequest, string, error) {
+	enc, err := requestEncoding(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "read body")
+	}
+
+	req, err := decodeBody(enc, compressed)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return req, enc, nil
+}
+
+// decodeBody decodes a protobuf remote write request of the given content encoding.
+func decodeBody(enc string, compressed []byte) (*prompb.WriteRequest, error) {
+	buf, err := compression.Decode(enc, compressed)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s decode", enc)
+	}
+
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return nil, errors.Wrap(err, "proto unmarshal")
+	}
+
+	return &req, nil
+}
+
+// decodeFailed answers a request that could not be decoded, with 415 if its content encoding is not supported.
+func decodeFailed(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+
+	if errors.Is(err, compression.ErrUnsupported) {
+		w.Header().Set("Accept-Encoding", strings.Join(compression.Encodings, ", "))
+		code = http.StatusUnsupportedMediaType
+	}
+
+	http.Error(w, err.Error(), code)
+}
+
+// replaceBody replaces the body of the given HTTP request, after its remote write request was rewritten.
+func replaceBody(r *http.Request, body []byte) {
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// encodeRequest encodes the given remote write request as protobuf of the given content encoding.
+func encodeRequest(enc string, req *prompb.WriteRequest) ([]byte, error) {
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "proto marshal")
+	}
+
+	body, err := compression.Encode(enc, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s encode", enc)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/api/trace"
+
+	"github.com/kakkoyun/observable-remote-write/internal/compression"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// replicaRequest returns a request of the given number of series, as sent by the given replica of an HA pair.
+func replicaRequest(replica string, series int) *prompb.WriteRequest {
+	req := &prompb.WriteRequest{}
+
+	for i := 0; i < series; i++ {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "__replica__", Value: replica},
+				{Name: "cluster", Value: "eu"},
+				{Name: "instance", Value: fmt.Sprintf("i%d", i)},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		})
+	}
+
+	return req
+}
+
+func TestDistributorShardsHAReplicasTogether(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		excluded []string
+		together bool
+	}{
+		{name: "replica label excluded", excluded: []string{"__replica__"}, together: true},
+		{name: "replica and cluster labels excluded", excluded: []string{"__replica__", "cluster"}, together: true},
+		{name: "replica label hashed", together: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mtx sync.Mutex
+				// received maps series, without their replica label, to the targets that received them.
+				received = map[string]map[string]struct{}{}
+				addrs    []url.URL
+			)
+
+			for i := 0; i < 3; i++ {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					req, _, err := decodeRequest(r)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+
+					mtx.Lock()
+					defer mtx.Unlock()
+
+					for _, ts := range req.Timeseries {
+						var names []string
+
+						for _, l := range ts.Labels {
+							if l.Name != "__replica__" {
+								names = append(names, l.Name+"="+l.Value)
+							}
+						}
+
+						key := strings.Join(names, ",")
+						if received[key] == nil {
+							received[key] = map[string]struct{}{}
+						}
+
+						received[key][r.Host] = struct{}{}
+					}
+				}))
+				defer srv.Close()
+
+				u, err := url.Parse(srv.URL + "/receive")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				addrs = append(addrs, *u)
+			}
+
+			reg := prometheus.NewRegistry()
+			d := NewDistributor(log.NewNopLogger(), trace.NoopTracer{}, reg, lbtransport.NewStaticDiscovery(addrs, reg),
+				http.DefaultClient, DistributorOptions{
+					TenantHeader:  "THANOS-TENANT",
+					ShardSeries:   true,
+					VirtualNodes:  16,
+					ExcludeLabels: tc.excluded,
+				})
+
+			for _, replica := range []string{"a", "b"} {
+				body, err := encodeRequest(compression.Snappy, replicaRequest(replica, 50))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				r := httptest.NewRequest(http.MethodPost, "/receive", bytes.NewReader(body))
+				r.Header.Set("Content-Encoding", compression.Snappy)
+				r = r.WithContext(tenancy.NewContext(r.Context(), "team-a"))
+
+				w := httptest.NewRecorder()
+				d.ServeHTTP(w, r)
+
+				if w.Code/100 != 2 {
+					t.Fatalf("replica %s: got status %d: %s", replica, w.Code, w.Body.String())
+				}
+			}
+
+			together := true
+			for series, targets := range received {
+				if len(targets) != 1 {
+					if tc.together {
+						t.Errorf("copies of series %s were written to %d targets, want 1", series, len(targets))
+					}
+
+					together = false
+				}
+			}
+
+			if together != tc.together {
+				t.Errorf("got copies of all series written to the same target %v, want %v", together, tc.together)
+			}
+		})
+	}
+}
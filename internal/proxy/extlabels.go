@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kakkoyun/observable-remote-write/internal/labelpb"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// ExternalLabelsConfig configures the external labels added to the series of requests.
+//
+//	labels:
+//	  cluster: eu1
+//	  region: eu
+//	tenant_label: tenant
+//	tenants:
+//	  team-a:
+//	    cluster: eu2
+type ExternalLabelsConfig struct {
+	// Labels are added to the series of all tenants.
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// TenantLabel is the name of a label set to the tenant of a request, if not empty.
+	TenantLabel string `yaml:"tenant_label,omitempty"`
+	// Tenants are labels by tenant that are added on top of, or replace, the ones of all tenants.
+	Tenants map[string]map[string]string `yaml:"tenants,omitempty"`
+	// Override replaces the values of labels series already have.
+	// By default, like Prometheus external labels, labels of series take precedence.
+	Override bool `yaml:"override,omitempty"`
+}
+
+// LoadExternalLabelsConfig reads and validates the external labels in the given file.
+func LoadExternalLabelsConfig(path string) (*ExternalLabelsConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	var cfg ExternalLabelsConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parse file %s", path)
+	}
+
+	if cfg.TenantLabel != "" && !model.LabelName(cfg.TenantLabel).IsValid() {
+		return nil, errors.Errorf("invalid tenant label name %q", cfg.TenantLabel)
+	}
+
+	for name, value := range cfg.Labels {
+		if err := validateExternalLabel(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for tenant, lbls := range cfg.Tenants {
+		for name, value := range lbls {
+			if err := validateExternalLabel(name, value); err != nil {
+				return nil, errors.Wrapf(err, "tenant %q", tenant)
+			}
+		}
+	}
+
+	return &cfg, nil
+}
+
+func validateExternalLabel(name, value string) error {
+	if !model.LabelName(name).IsValid() || name == labels.MetricName {
+		return errors.Errorf("invalid external label name %q", name)
+	}
+
+	if value == "" {
+		return errors.Errorf("empty value of external label %q", name)
+	}
+
+	return nil
+}
+
+// ExternalLabeler is a http.Handler that adds external labels to the series of requests before handing them to the next handler.
+type ExternalLabeler struct {
+	next   http.Handler
+	logger log.Logger
+	tracer trace.Tracer
+	cfg    ExternalLabelsConfig
+
+	series *prometheus.CounterVec
+}
+
+// NewExternalLabeler creates a new handler adding the configured external labels to the series of requests.
+func NewExternalLabeler(
+	logger log.Logger,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+	next http.Handler,
+	cfg ExternalLabelsConfig,
+) *ExternalLabeler {
+	return &ExternalLabeler{
+		next:   next,
+		logger: logger,
+		tracer: tracer,
+		cfg:    cfg,
+		series: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_external_labels_series_total",
+				Help: "Tracks the number of series external labels were added to.",
+			},
+			[]string{"tenant"},
+		),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (e *ExternalLabeler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tenant := tenancy.FromContext(req.Context())
+
+	lbls := e.labels(tenant)
+	if len(lbls) == 0 {
+		e.next.ServeHTTP(w, req)
+		return
+	}
+
+	ctx, span := e.tracer.Start(req.Context(), "external_labels")
+
+	wreq, enc, err := decodeRequest(req)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Debug(e.logger).Log("msg", "failed to decode request", "err", err)
+		decodeFailed(w, err)
+
+		return
+	}
+
+	for i, ts := range wreq.Timeseries {
+		b := labels.NewBuilder(labelpb.ToLabels(ts.Labels))
+
+		for _, l := range lbls {
+			if !e.cfg.Override {
+				if hasLabel(ts.Labels, l.Name) {
+					continue
+				}
+			}
+
+			b.Set(l.Name, l.Value)
+		}
+
+		// The builder returns labels sorted by name, as required by remote write.
+		wreq.Timeseries[i].Labels = labelpb.FromLabels(b.Labels())
+	}
+
+	e.series.WithLabelValues(tenant).Add(float64(len(wreq.Timeseries)))
+	span.SetAttributes(kv.Int("series", len(wreq.Timeseries)))
+
+	body, err := encodeRequest(enc, wreq)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Error(e.logger).Log("msg", "failed to encode request", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	span.End()
+	replaceBody(req, body)
+
+	e.next.ServeHTTP(w, req)
+}
+
+// labels returns the external labels of the given tenant.
+func (e *ExternalLabeler) labels(tenant string) labels.Labels {
+	m := make(map[string]string, len(e.cfg.Labels)+1)
+
+	for name, value := range e.cfg.Labels {
+		m[name] = value
+	}
+
+	for name, value := range e.cfg.Tenants[tenant] {
+		m[name] = value
+	}
+
+	if e.cfg.TenantLabel != "" && tenant != "" {
+		m[e.cfg.TenantLabel] = tenant
+	}
+
+	return labels.FromMap(m)
+}
+
+func hasLabel(lps []prompb.Label, name string) bool {
+	for _, l := range lps {
+		if l.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
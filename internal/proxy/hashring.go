@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// sep separates label names and values when hashing, as it cannot occur in valid UTF-8.
+var sep = []byte{'\xff'}
+
+// Hashring is a consistent hash ring of targets.
+// Every target owns a number of virtual nodes, so that adding or removing a target only moves its share of the series.
+type Hashring struct {
+	tokens  []uint64
+	targets []*lbtransport.Target
+}
+
+// NewHashring creates a new hash ring of the given targets with the given number of virtual nodes per target.
+func NewHashring(targets []*lbtransport.Target, virtualNodes int) *Hashring {
+	if virtualNodes < 1 {
+		virtualNodes = 1
+	}
+
+	type node struct {
+		token  uint64
+		target *lbtransport.Target
+	}
+
+	nodes := make([]node, 0, len(targets)*virtualNodes)
+
+	for _, t := range targets {
+		addr := t.DialAddr.String()
+		for i := 0; i < virtualNodes; i++ {
+			nodes = append(nodes, node{token: xxhash.Sum64String(addr + "-" + strconv.Itoa(i)), target: t})
+		}
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].token < nodes[j].token })
+
+	h := &Hashring{
+		tokens:  make([]uint64, 0, len(nodes)),
+		targets: make([]*lbtransport.Target, 0, len(nodes)),
+	}
+
+	for _, n := range nodes {
+		h.tokens = append(h.tokens, n.token)
+		h.targets = append(h.targets, n.target)
+	}
+
+	return h
+}
+
+// Get returns the target owning the given hash, or nil if the ring is empty.
+func (h *Hashring) Get(hash uint64) *lbtransport.Target {
+	if len(h.tokens) == 0 {
+		return nil
+	}
+
+	i := sort.Search(len(h.tokens), func(i int) bool { return h.tokens[i] >= hash })
+	if i == len(h.tokens) {
+		i = 0
+	}
+
+	return h.targets[i]
+}
+
+// GetN returns up to n distinct targets owning the given hash, walking the ring clockwise from its owner.
+func (h *Hashring) GetN(hash uint64, n int) []*lbtransport.Target {
+	if len(h.tokens) == 0 {
+		return nil
+	}
+
+	res := make([]*lbtransport.Target, 0, n)
+	start := sort.Search(len(h.tokens), func(i int) bool { return h.tokens[i] >= hash })
+
+	for i := 0; i < len(h.tokens) && len(res) < n; i++ {
+		t := h.targets[(start+i)%len(h.tokens)]
+		if !contains(res, t) {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+func contains(targets []*lbtransport.Target, t *lbtransport.Target) bool {
+	for _, c := range targets {
+		if c == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hashSeries returns the hash of the given label set without the excluded labels,
+// prefixed by the given tenant if it is not empty.
+func hashSeries(tenant string, ls []prompb.Label, excluded []string) uint64 {
+	d := xxhash.New()
+
+	if tenant != "" {
+		_, _ = d.WriteString(tenant)
+		_, _ = d.Write(sep)
+	}
+
+Labels:
+	for _, l := range ls {
+		for _, name := range excluded {
+			if l.Name == name {
+				continue Labels
+			}
+		}
+
+		_, _ = d.WriteString(l.Name)
+		_, _ = d.Write(sep)
+		_, _ = d.WriteString(l.Value)
+		_, _ = d.Write(sep)
+	}
+
+	return d.Sum64()
+}
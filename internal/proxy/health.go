@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kakkoyun/observable-remote-write/internal"
+)
+
+// HealthOptions configures a HealthChecker.
+type HealthOptions struct {
+	// Interval is the time between two probes of a target.
+	Interval time.Duration
+	// Timeout is the time after which a probe is considered failed.
+	Timeout time.Duration
+	// Path is the path of the readiness endpoint of the targets.
+	Path string
+	// PortOffset is the difference between the port of the internal server of a target, that serves the readiness endpoint,
+	// and the port it receives requests on.
+	PortOffset int
+}
+
+// HealthChecker is a discovery that probes the readiness of the targets of another discovery on an interval
+// and only returns the healthy ones. Targets that were not probed yet are considered healthy.
+type HealthChecker struct {
+	logger    log.Logger
+	discovery lbtransport.Discovery
+	client    *http.Client
+	opts      HealthOptions
+
+	mtx       sync.RWMutex
+	unhealthy map[string]struct{}
+	probed    map[string]struct{}
+
+	healthy *prometheus.GaugeVec
+	probes  *prometheus.CounterVec
+}
+
+// NewHealthChecker creates a new health checker of the targets of the given discovery.
+func NewHealthChecker(logger log.Logger, reg prometheus.Registerer, discovery lbtransport.Discovery, opts HealthOptions) *HealthChecker {
+	return &HealthChecker{
+		logger:    logger,
+		discovery: discovery,
+		client:    &http.Client{Timeout: opts.Timeout},
+		opts:      opts,
+		unhealthy: map[string]struct{}{},
+		probed:    map[string]struct{}{},
+		healthy: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_target_healthy",
+				Help: "Whether the last readiness probe of a target succeeded.",
+			},
+			[]string{"target"},
+		),
+		probes: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_target_probes_total",
+				Help: "Tracks the number of readiness probes of targets.",
+			},
+			[]string{"target", "result"},
+		),
+	}
+}
+
+// Targets returns the targets of the underlying discovery that are not known to be unhealthy.
+func (h *HealthChecker) Targets() []*lbtransport.Target {
+	targets := h.discovery.Targets()
+
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	healthy := make([]*lbtransport.Target, 0, len(targets))
+
+	for _, t := range targets {
+		if _, ok := h.unhealthy[t.DialAddr.String()]; !ok {
+			healthy = append(healthy, t)
+		}
+	}
+
+	return healthy
+}
+
+// Ready returns an error unless at least one target is healthy.
+func (h *HealthChecker) Ready() error {
+	if len(h.Targets()) == 0 {
+		return errors.New("no healthy targets")
+	}
+
+	return nil
+}
+
+// Run probes all targets on the configured interval until the given context is canceled.
+func (h *HealthChecker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		h.probeAll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll probes all current targets concurrently and forgets the ones that disappeared.
+func (h *HealthChecker) probeAll(ctx context.Context) {
+	var (
+		targets = h.discovery.Targets()
+		current = make(map[string]struct{}, len(targets))
+		wg      sync.WaitGroup
+	)
+
+	for _, t := range targets {
+		addr := t.DialAddr.String()
+		current[addr] = struct{}{}
+
+		wg.Add(1)
+
+		go func(t *lbtransport.Target, addr string) {
+			defer wg.Done()
+
+			h.update(addr, h.probe(ctx, t))
+		}(t, addr)
+	}
+
+	wg.Wait()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	for a := range h.probed {
+		if _, ok := current[a]; !ok {
+			delete(h.probed, a)
+			delete(h.unhealthy, a)
+			h.healthy.DeleteLabelValues(a)
+		}
+	}
+}
+
+// update records the result of a probe of the given target.
+func (h *HealthChecker) update(target string, err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	_, wasUnhealthy := h.unhealthy[target]
+	h.probed[target] = struct{}{}
+
+	if err != nil {
+		if !wasUnhealthy {
+			level.Warn(h.logger).Log("msg", "target became unhealthy", "target", target, "err", err)
+		}
+
+		h.unhealthy[target] = struct{}{}
+		h.healthy.WithLabelValues(target).Set(0)
+		h.probes.WithLabelValues(target, "failure").Inc()
+
+		return
+	}
+
+	if wasUnhealthy {
+		level.Info(h.logger).Log("msg", "target became healthy", "target", target)
+	}
+
+	delete(h.unhealthy, target)
+	h.healthy.WithLabelValues(target).Set(1)
+	h.probes.WithLabelValues(target, "success").Inc()
+}
+
+// probe requests the readiness endpoint of the given target.
+func (h *HealthChecker) probe(ctx context.Context, t *lbtransport.Target) error {
+	u, err := h.probeURL(t)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+
+	res, err := h.client.Do(r)
+	if err != nil {
+		return errors.Wrap(err, "probe")
+	}
+
+	defer internal.ExhaustCloseWithLogOnErr(h.logger, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("probe returned HTTP status %s", res.Status)
+	}
+
+	return nil
+}
+
+// probeURL returns the URL of the readiness endpoint of the given target.
+func (h *HealthChecker) probeURL(t *lbtransport.Target) (string, error) {
+	u := t.DialAddr
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse port of target %s", u.String())
+	}
+
+	u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(p+h.opts.PortOffset))
+	u.Path = h.opts.Path
+	u.RawQuery = ""
+
+	return u.String(), nil
+}
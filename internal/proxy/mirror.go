@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kakkoyun/observable-remote-write/internal"
+	"github.com/kakkoyun/observable-remote-write/internal/http/middleware"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// MirrorOptions configures a Mirror.
+type MirrorOptions struct {
+	// TenantHeader is the header the tenant of a request is forwarded with.
+	TenantHeader string
+	// SampleRatio is the fraction of requests that are mirrored, between 0 and 1.
+	SampleRatio float64
+	// MaxInFlight is the maximum number of mirrored requests in flight per target. Requests beyond it are dropped.
+	MaxInFlight int
+	// Timeout is the time after which mirrored requests are canceled.
+	Timeout time.Duration
+}
+
+// Mirror is a http.Handler that copies requests to shadow targets before handing them to the next handler.
+// Copies are sent asynchronously and their responses are ignored, so that shadow targets never slow down
+// or fail the requests of clients. If too many copies to a target are in flight, further ones are dropped.
+type Mirror struct {
+	next    http.Handler
+	logger  log.Logger
+	client  *http.Client
+	targets []mirrorTarget
+	opts    MirrorOptions
+
+	mtx sync.Mutex
+	rnd *rand.Rand
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	dropped  *prometheus.CounterVec
+	inFlight *prometheus.GaugeVec
+}
+
+type mirrorTarget struct {
+	url url.URL
+	sem chan struct{}
+}
+
+// NewMirror creates a new handler that mirrors requests to the given targets.
+func NewMirror(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	next http.Handler,
+	targets []url.URL,
+	client *http.Client,
+	opts MirrorOptions,
+) *Mirror {
+	m := &Mirror{
+		next:   next,
+		logger: logger,
+		client: client,
+		opts:   opts,
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		requests: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_mirror_requests_total",
+				Help: "Tracks the number of requests mirrored to a target, by the status code of their response.",
+			},
+			[]string{"target", "code"},
+		),
+		duration: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "proxy_mirror_request_duration_seconds",
+				Help:    "Tracks the latencies of requests mirrored to a target.",
+				Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
+			},
+			[]string{"target"},
+		),
+		dropped: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_mirror_dropped_requests_total",
+				Help: "Tracks the number of requests not mirrored to a target, because too many were in flight.",
+			},
+			[]string{"target"},
+		),
+		inFlight: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_mirror_in_flight_requests",
+				Help: "The number of requests mirrored to a target that are in flight.",
+			},
+			[]string{"target"},
+		),
+	}
+
+	for _, t := range targets {
+		m.targets = append(m.targets, mirrorTarget{url: t, sem: make(chan struct{}, opts.MaxInFlight)})
+		m.dropped.WithLabelValues(t.String())
+		m.inFlight.WithLabelValues(t.String())
+	}
+
+	return m
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !m.sample() {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	header := r.Header.Clone()
+	header.Set(m.opts.TenantHeader, tenancy.FromContext(r.Context()))
+
+	if rid := middleware.RequestIDFromContext(r.Context()); rid != "" {
+		header.Set("X-Request-ID", rid)
+	}
+
+	for _, t := range m.targets {
+		select {
+		case t.sem <- struct{}{}:
+			go m.send(t, header, body)
+		default:
+			m.dropped.WithLabelValues(t.url.String()).Inc()
+		}
+	}
+
+	m.next.ServeHTTP(w, r)
+}
+
+// sample decides whether a request is mirrored.
+func (m *Mirror) sample() bool {
+	if m.opts.SampleRatio >= 1 {
+		return true
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	return m.rnd.Float64() < m.opts.SampleRatio
+}
+
+// send sends a copy of a request to the given target and releases its slot when done.
+func (m *Mirror) send(t mirrorTarget, header http.Header, body []byte) {
+	addr := t.url.String()
+
+	m.inFlight.WithLabelValues(addr).Inc()
+
+	defer func() {
+		m.inFlight.WithLabelValues(addr).Dec()
+		<-t.sem
+	}()
+
+	// The copy outlives the request of the client, so it must not inherit its context.
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	code, err := m.do(ctx, addr, header, body)
+
+	m.duration.WithLabelValues(addr).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.requests.WithLabelValues(addr, "error").Inc()
+		level.Debug(m.logger).Log("msg", "failed to mirror request", "target", addr, "err", err)
+
+		return
+	}
+
+	m.requests.WithLabelValues(addr, strconv.Itoa(code)).Inc()
+}
+
+func (m *Mirror) do(ctx context.Context, addr string, header http.Header, body []byte) (int, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "new request")
+	}
+
+	r.Header = header.Clone()
+
+	res, err := m.client.Do(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "send request")
+	}
+
+	internal.ExhaustCloseWithLogOnErr(m.logger, res.Body)
+
+	return res.StatusCode, nil
+}
@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Names of the pickers.
+const (
+	PickerRoundRobin       = "round-robin"
+	PickerLeastOutstanding = "least-outstanding"
+	PickerP2CInFlight      = "p2c-inflight"
+	PickerP2CEWMA          = "p2c-ewma"
+	PickerWeighted         = "weighted"
+)
+
+// exclusions keeps track of targets excluded for a backoff period, like lbtransport.RoundRobinPicker does.
+type exclusions struct {
+	backoff time.Duration
+
+	mtx   sync.RWMutex
+	until map[string]time.Time
+}
+
+func newExclusions(backoff time.Duration) *exclusions {
+	return &exclusions{backoff: backoff, until: map[string]time.Time{}}
+}
+
+func (e *exclusions) exclude(t *lbtransport.Target) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	e.until[t.DialAddr.String()] = time.Now().Add(e.backoff)
+}
+
+func (e *exclusions) excluded(t *lbtransport.Target) bool {
+	e.mtx.RLock()
+	until, ok := e.until[t.DialAddr.String()]
+	e.mtx.RUnlock()
+
+	return ok && time.Now().Before(until)
+}
+
+// available returns the targets that are not excluded.
+func (e *exclusions) available(targets []*lbtransport.Target) []*lbtransport.Target {
+	res := make([]*lbtransport.Target, 0, len(targets))
+
+	for _, t := range targets {
+		if !e.excluded(t) {
+			res = append(res, t)
+		}
+	}
+
+	return res
+}
+
+// pickerMetrics are the metrics every picker exports about its decisions.
+type pickerMetrics struct {
+	picks    *prometheus.CounterVec
+	inFlight *prometheus.GaugeVec
+}
+
+func newPickerMetrics(reg prometheus.Registerer, picker string) *pickerMetrics {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"picker": picker}, reg)
+
+	return &pickerMetrics{
+		picks: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_picker_picks_total",
+				Help: "Tracks the number of times a target was picked.",
+			},
+			[]string{"target"},
+		),
+		inFlight: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_picker_in_flight_requests",
+				Help: "The number of requests in flight per target, as seen by the picker.",
+			},
+			[]string{"target"},
+		),
+	}
+}
+
+// inFlight counts the requests in flight per target, from their pick until they are observed.
+type inFlight struct {
+	metrics *pickerMetrics
+
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+func newInFlight(metrics *pickerMetrics) *inFlight {
+	return &inFlight{metrics: metrics, counts: map[string]int{}}
+}
+
+func (f *inFlight) get(t *lbtransport.Target) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.counts[t.DialAddr.String()]
+}
+
+func (f *inFlight) inc(t *lbtransport.Target) {
+	addr := t.DialAddr.String()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.counts[addr]++
+	f.metrics.picks.WithLabelValues(addr).Inc()
+	f.metrics.inFlight.WithLabelValues(addr).Set(float64(f.counts[addr]))
+}
+
+func (f *inFlight) dec(t *lbtransport.Target) {
+	addr := t.DialAddr.String()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.counts[addr] > 0 {
+		f.counts[addr]--
+	}
+
+	f.metrics.inFlight.WithLabelValues(addr).Set(float64(f.counts[addr]))
+}
+
+// LeastOutstandingPicker picks the target with the fewest requests in flight, so that slow targets receive less traffic.
+// Ties are broken in turn.
+type LeastOutstandingPicker struct {
+	*exclusions
+	inFlight *inFlight
+
+	mtx  sync.Mutex
+	next int
+}
+
+// NewLeastOutstandingPicker creates a new picker of the target with the fewest requests in flight.
+// Targets are excluded for the given backoff after they could not be dialed.
+func NewLeastOutstandingPicker(reg prometheus.Registerer, backoff time.Duration) *LeastOutstandingPicker {
+	return &LeastOutstandingPicker{
+		exclusions: newExclusions(backoff),
+		inFlight:   newInFlight(newPickerMetrics(reg, PickerLeastOutstanding)),
+	}
+}
+
+// Pick implements lbtransport.TargetPicker.
+func (p *LeastOutstandingPicker) Pick(targets []*lbtransport.Target) *lbtransport.Target {
+	available := p.available(targets)
+	if len(available) == 0 {
+		return nil
+	}
+
+	p.mtx.Lock()
+	start := p.next
+	p.next++
+	p.mtx.Unlock()
+
+	var (
+		best      *lbtransport.Target
+		bestCount = math.MaxInt32
+	)
+
+	for i := range available {
+		t := available[(start+i)%len(available)]
+		if c := p.inFlight.get(t); c < bestCount {
+			best, bestCount = t, c
+		}
+	}
+
+	p.inFlight.inc(best)
+
+	return best
+}
+
+// ExcludeTarget implements lbtransport.TargetPicker.
+func (p *LeastOutstandingPicker) ExcludeTarget(t *lbtransport.Target) {
+	p.exclude(t)
+}
+
+// Observe implements Observer.
+func (p *LeastOutstandingPicker) Observe(t *lbtransport.Target, _ time.Duration, _ int, _ error) {
+	p.inFlight.dec(t)
+}
+
+// P2CPicker picks the less loaded of two random targets, the power of two choices.
+// The load of a target is either its number of requests in flight or its peak EWMA latency weighted by it.
+// Unlike picking the least loaded of all targets, it avoids herding on a single target with stale load information.
+type P2CPicker struct {
+	*exclusions
+	inFlight *inFlight
+	useEWMA  bool
+	decay    time.Duration
+
+	mtx      sync.Mutex
+	rnd      *rand.Rand
+	ewma     map[string]float64
+	lastSeen map[string]time.Time
+
+	latency *prometheus.GaugeVec
+}
+
+// NewP2CPicker creates a new power of two choices picker.
+// If useEWMA is set, targets are compared by their latency EWMA, decaying with the given time constant.
+// Targets are excluded for the given backoff after they could not be dialed.
+func NewP2CPicker(reg prometheus.Registerer, backoff time.Duration, useEWMA bool, decay time.Duration) *P2CPicker {
+	name := PickerP2CInFlight
+	if useEWMA {
+		name = PickerP2CEWMA
+	}
+
+	return &P2CPicker{
+		exclusions: newExclusions(backoff),
+		inFlight:   newInFlight(newPickerMetrics(reg, name)),
+		useEWMA:    useEWMA,
+		decay:      decay,
+		rnd:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		ewma:       map[string]float64{},
+		lastSeen:   map[string]time.Time{},
+		latency: promauto.With(prometheus.WrapRegistererWith(prometheus.Labels{"picker": name}, reg)).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "proxy_picker_latency_ewma_seconds",
+				Help: "The exponentially weighted moving average of the latency per target, as seen by the picker.",
+			},
+			[]string{"target"},
+		),
+	}
+}
+
+// Pick implements lbtransport.TargetPicker.
+func (p *P2CPicker) Pick(targets []*lbtransport.Target) *lbtransport.Target {
+	available := p.available(targets)
+
+	var picked *lbtransport.Target
+
+	switch len(available) {
+	case 0:
+		return nil
+	case 1:
+		picked = available[0]
+	default:
+		p.mtx.Lock()
+		i := p.rnd.Intn(len(available))
+		j := p.rnd.Intn(len(available) - 1)
+		p.mtx.Unlock()
+
+		if j >= i {
+			j++
+		}
+
+		a, b := available[i], available[j]
+
+		picked = a
+		if p.load(b) < p.load(a) {
+			picked = b
+		}
+	}
+
+	p.inFlight.inc(picked)
+
+	return picked
+}
+
+// load returns the load of the given target. Targets without observed latency have none, so that they are tried.
+func (p *P2CPicker) load(t *lbtransport.Target) float64 {
+	n := float64(p.inFlight.get(t))
+	if !p.useEWMA {
+		return n
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.ewma[t.DialAddr.String()] * (n + 1)
+}
+
+// ExcludeTarget implements lbtransport.TargetPicker.
+func (p *P2CPicker) ExcludeTarget(t *lbtransport.Target) {
+	p.exclude(t)
+}
+
+// Observe implements Observer.
+// Latencies higher than the average are taken as is, lower ones decay into it, so that the picker reacts fast to slow targets.
+func (p *P2CPicker) Observe(t *lbtransport.Target, d time.Duration, _ int, _ error) {
+	p.inFlight.dec(t)
+
+	if !p.useEWMA {
+		return
+	}
+
+	addr := t.DialAddr.String()
+	now := time.Now()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	sample := d.Seconds()
+	prev, ok := p.ewma[addr]
+
+	switch {
+	case !ok || sample > prev:
+		p.ewma[addr] = sample
+	default:
+		w := math.Exp(-now.Sub(p.lastSeen[addr]).Seconds() / p.decay.Seconds())
+		p.ewma[addr] = prev*w + sample*(1-w)
+	}
+
+	p.lastSeen[addr] = now
+	p.latency.WithLabelValues(addr).Set(p.ewma[addr])
+}
+
+// WeightedPicker distributes requests over the targets in proportion to static weights,
+// using the smooth weighted round-robin of nginx, which interleaves the picks of the targets.
+type WeightedPicker struct {
+	*exclusions
+	weights       map[string]int
+	defaultWeight int
+
+	mtx     sync.Mutex
+	current map[string]int
+
+	picks *prometheus.CounterVec
+}
+
+// NewWeightedPicker creates a new picker distributing requests in proportion to the given weights by target URL.
+// Targets without a weight get the default one. Targets are excluded for the given backoff after they could not be dialed.
+func NewWeightedPicker(reg prometheus.Registerer, backoff time.Duration, weights map[string]int, defaultWeight int) *WeightedPicker {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"picker": PickerWeighted}, reg)
+
+	p := &WeightedPicker{
+		exclusions:    newExclusions(backoff),
+		weights:       weights,
+		defaultWeight: defaultWeight,
+		current:       map[string]int{},
+		picks: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_picker_picks_total",
+				Help: "Tracks the number of times a target was picked.",
+			},
+			[]string{"target"},
+		),
+	}
+
+	weight := promauto.With(reg).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "proxy_picker_target_weight",
+			Help: "The configured weight of a target.",
+		},
+		[]string{"target"},
+	)
+	for addr, w := range weights {
+		weight.WithLabelValues(addr).Set(float64(w))
+	}
+
+	return p
+}
+
+// Pick implements lbtransport.TargetPicker.
+func (p *WeightedPicker) Pick(targets []*lbtransport.Target) *lbtransport.Target {
+	available := p.available(targets)
+	if len(available) == 0 {
+		return nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var (
+		best  *lbtransport.Target
+		total int
+	)
+
+	for _, t := range available {
+		addr := t.DialAddr.String()
+
+		w, ok := p.weights[addr]
+		if !ok {
+			w = p.defaultWeight
+		}
+
+		p.current[addr] += w
+		total += w
+
+		if best == nil || p.current[addr] > p.current[best.DialAddr.String()] {
+			best = t
+		}
+	}
+
+	p.current[best.DialAddr.String()] -= total
+	p.picks.WithLabelValues(best.DialAddr.String()).Inc()
+
+	return best
+}
+
+// ExcludeTarget implements lbtransport.TargetPicker.
+func (p *WeightedPicker) ExcludeTarget(t *lbtransport.Target) {
+	p.exclude(t)
+}
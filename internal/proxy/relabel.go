@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kakkoyun/observable-remote-write/internal/labelpb"
+)
+
+// LoadRelabelConfigs reads the relabel configs in the given file, a list in the format of Prometheus relabel_configs.
+func LoadRelabelConfigs(path string) ([]*relabel.Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	var cfgs []*relabel.Config
+	if err := yaml.UnmarshalStrict(b, &cfgs); err != nil {
+		return nil, errors.Wrapf(err, "parse file %s", path)
+	}
+
+	return cfgs, nil
+}
+
+// Relabeler is a http.Handler that applies relabel configs to the series of requests before handing them to the next handler.
+// Series that are dropped by the configs are removed from requests. Requests left without series and metadata are
+// answered with 200 and not handed on.
+type Relabeler struct {
+	next    http.Handler
+	logger  log.Logger
+	tracer  trace.Tracer
+	configs []*relabel.Config
+
+	series  *prometheus.CounterVec
+	dropped prometheus.Counter
+}
+
+// NewRelabeler creates a new handler relabeling the series of requests with the given configs.
+func NewRelabeler(
+	logger log.Logger,
+	tracer trace.Tracer,
+	reg prometheus.Registerer,
+	next http.Handler,
+	configs []*relabel.Config,
+) *Relabeler {
+	r := &Relabeler{
+		next:    next,
+		logger:  logger,
+		tracer:  tracer,
+		configs: configs,
+		series: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_relabel_series_total",
+				Help: "Tracks the number of series relabeled, by whether they were kept or dropped.",
+			},
+			[]string{"result"},
+		),
+		dropped: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_relabel_dropped_requests_total",
+				Help: "Tracks the number of requests not handed on, as all of their series were dropped.",
+			},
+		),
+	}
+
+	for _, result := range []string{"kept", "dropped"} {
+		r.series.WithLabelValues(result)
+	}
+
+	return r
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Relabeler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, span := r.tracer.Start(req.Context(), "relabel")
+
+	wreq, enc, err := decodeRequest(req)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Debug(r.logger).Log("msg", "failed to decode request", "err", err)
+		decodeFailed(w, err)
+
+		return
+	}
+
+	before := len(wreq.Timeseries)
+	kept := wreq.Timeseries[:0]
+
+	for _, ts := range wreq.Timeseries {
+		lset := relabel.Process(labelpb.ToLabels(ts.Labels), r.configs...)
+		if lset == nil {
+			continue
+		}
+
+		ts.Labels = labelpb.FromLabels(lset)
+		kept = append(kept, ts)
+	}
+
+	wreq.Timeseries = kept
+
+	r.series.WithLabelValues("kept").Add(float64(len(kept)))
+	r.series.WithLabelValues("dropped").Add(float64(before - len(kept)))
+	span.SetAttributes(kv.Int("series", before), kv.Int("series_dropped", before-len(kept)))
+
+	if len(kept) == 0 && len(wreq.XXX_unrecognized) == 0 {
+		span.End()
+		r.dropped.Inc()
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	body, err := encodeRequest(enc, wreq)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Error(r.logger).Log("msg", "failed to encode request", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	span.End()
+
+	replaceBody(req, body)
+
+	r.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+const (
+	retryReasonError           = "error"
+	retryReasonServerError     = "server_error"
+	retryReasonTooManyRequests = "too_many_requests"
+)
+
+// RetryOptions configures a RetryTransport.
+type RetryOptions struct {
+	// MaxAttempts is the maximum number of attempts per request, including the first one.
+	MaxAttempts int
+	// MinBackoff is the time to wait before the first retry. It doubles with every further retry.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time to wait before a retry.
+	// Responses asking to retry after a longer time are returned as is.
+	MaxBackoff time.Duration
+	// BudgetRatio is the number of retries allowed per request, on average.
+	BudgetRatio float64
+	// BudgetMinPerSecond is the number of retries allowed per second regardless of the number of requests.
+	BudgetMinPerSecond float64
+}
+
+// RetryTransport is a http.RoundTripper that retries failed requests with exponential backoff.
+// Connection errors, server errors and rate limited requests are retried, honouring the Retry-After header.
+// As every attempt goes through the next round tripper, a load balancing transport picks a different target for it.
+// Retries are capped by a budget shared by all requests, so that failing targets do not cause retry storms.
+type RetryTransport struct {
+	next   http.RoundTripper
+	tracer trace.Tracer
+	opts   RetryOptions
+	budget *retryBudget
+
+	retries         *prometheus.CounterVec
+	budgetExhausted prometheus.Counter
+}
+
+// NewRetryTransport creates a new round tripper retrying requests sent with the given round tripper.
+func NewRetryTransport(next http.RoundTripper, tracer trace.Tracer, reg prometheus.Registerer, opts RetryOptions) *RetryTransport {
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+
+	t := &RetryTransport{
+		next:   next,
+		tracer: tracer,
+		opts:   opts,
+		budget: newRetryBudget(opts.BudgetRatio, opts.BudgetMinPerSecond),
+		retries: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_request_retries_total",
+				Help: "Tracks the number of retried requests.",
+			},
+			[]string{"reason"},
+		),
+		budgetExhausted: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_retry_budget_exhausted_total",
+				Help: "Tracks the number of failed requests not retried because the retry budget was exhausted.",
+			},
+		),
+	}
+
+	for _, reason := range []string{retryReasonError, retryReasonServerError, retryReasonTooManyRequests} {
+		t.retries.WithLabelValues(reason)
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RetryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var body []byte
+
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+
+		body, err = ioutil.ReadAll(r.Body)
+		if cerr := r.Body.Close(); err == nil {
+			err = cerr
+		}
+
+		if err != nil {
+			return nil, errors.Wrap(err, "read request body")
+		}
+	}
+
+	t.budget.deposit()
+
+	backoff := t.opts.MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		res, err := t.attempt(r, body, attempt)
+
+		reason, retryable := retryReason(res, err)
+		if !retryable || attempt >= t.opts.MaxAttempts || r.Context().Err() != nil {
+			return res, err
+		}
+
+		wait := jitter(backoff)
+		if after, ok := retryAfter(res); ok {
+			wait = after
+		}
+
+		if wait > t.opts.MaxBackoff {
+			return res, err
+		}
+
+		if !t.budget.withdraw() {
+			t.budgetExhausted.Inc()
+			return res, err
+		}
+
+		if res != nil {
+			_, _ = ioutil.ReadAll(res.Body)
+			_ = res.Body.Close()
+		}
+
+		t.retries.WithLabelValues(reason).Inc()
+
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(wait):
+		}
+
+		if backoff *= 2; backoff > t.opts.MaxBackoff {
+			backoff = t.opts.MaxBackoff
+		}
+	}
+}
+
+// attempt sends a copy of the request with the given body in a child span.
+func (t *RetryTransport) attempt(r *http.Request, body []byte, attempt int) (*http.Response, error) {
+	ctx, span := t.tracer.Start(r.Context(), "attempt", trace.WithAttributes(kv.Int("attempt", attempt)))
+	defer span.End()
+
+	req := r.Clone(ctx)
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(body)), nil }
+		req.ContentLength = int64(len(body))
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(ctx, err)
+		return nil, err
+	}
+
+	span.SetAttributes(kv.Int("http.status_code", res.StatusCode))
+
+	if res.Request != nil {
+		// Load balancing transports send the request to the target they picked.
+		span.SetAttributes(kv.String("target", res.Request.URL.Host))
+	}
+
+	return res, nil
+}
+
+// retryReason tells whether the outcome of an attempt is worth retrying, and why.
+func retryReason(res *http.Response, err error) (string, bool) {
+	switch {
+	case err != nil:
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return "", false
+		}
+
+		return retryReasonError, true
+	case res.StatusCode == http.StatusTooManyRequests:
+		return retryReasonTooManyRequests, true
+	case res.StatusCode/100 == 5 && res.StatusCode != http.StatusNotImplemented:
+		return retryReasonServerError, true
+	default:
+		return "", false
+	}
+}
+
+// retryAfter parses the Retry-After header of the given response, given in seconds or as HTTP date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil {
+		return 0, false
+	}
+
+	v := res.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+
+	if d, err := http.ParseTime(v); err == nil {
+		if wait := time.Until(d); wait > 0 {
+			return wait, true
+		}
+
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// jitter returns a random duration between half and all of the given one, so that retries of concurrent requests spread.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryBudget is a token bucket of retries. Every request deposits a fraction of a retry
+// and the bucket refills at a minimum rate, so that retries stay proportional to the traffic.
+// It holds up to ten seconds worth of the minimum rate, which bounds bursts of retries.
+type retryBudget struct {
+	ratio     float64
+	minPerSec float64
+	capacity  float64
+
+	mtx        sync.Mutex
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newRetryBudget(ratio, minPerSec float64) *retryBudget {
+	capacity := math.Max(10*minPerSec, 1)
+
+	return &retryBudget{
+		ratio:      ratio,
+		minPerSec:  minPerSec,
+		capacity:   capacity,
+		tokens:     capacity,
+		lastRefill: time.Now(),
+	}
+}
+
+// deposit adds the share of retries of a request to the budget.
+func (b *retryBudget) deposit() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.tokens = math.Min(b.tokens+b.ratio, b.capacity)
+}
+
+// withdraw takes a retry from the budget, reporting whether there was one left.
+func (b *retryBudget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.tokens+now.Sub(b.lastRefill).Seconds()*b.minPerSec, b.capacity)
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
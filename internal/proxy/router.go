@@ -0,0 +1,292 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"gopkg.in/yaml.v2"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// RoutingConfig is the routing table of the proxy, mapping requests to named pools of targets.
+//
+//	pools:
+//	  - name: eu
+//	    targets: ["http://10.0.0.1:8080/receive"]
+//	  - name: us
+//	    dns: ["dnssrv+_receive._tcp.us.example.org"]
+//	    picker: p2c-ewma
+//	routes:
+//	  - tenants: ["team-a"]
+//	    pool: eu
+//	  - external_labels: {region: us}
+//	    pool: us
+//	  - pool: eu
+type RoutingConfig struct {
+	Pools  []PoolConfig  `yaml:"pools"`
+	Routes []RouteConfig `yaml:"routes"`
+}
+
+// PoolConfig is a named pool of targets, with its own discovery and picker.
+type PoolConfig struct {
+	Name string `yaml:"name"`
+	// Targets are static target URLs.
+	Targets []string `yaml:"targets,omitempty"`
+	// File is a file to discover targets from, see discovery.File.
+	File string `yaml:"file,omitempty"`
+	// DNS are names to discover targets from, see discovery.DNS.
+	DNS []string `yaml:"dns,omitempty"`
+	// Picker is the name of the picker of the pool. It defaults to round-robin.
+	Picker string `yaml:"picker,omitempty"`
+	// Weights are the weights of targets by URL for the weighted picker.
+	Weights map[string]int `yaml:"weights,omitempty"`
+}
+
+// RouteConfig routes the requests matching all of its matchers to a pool. A route without matchers matches every request.
+type RouteConfig struct {
+	// Tenants matches requests of any of the given tenants.
+	Tenants []string `yaml:"tenants,omitempty"`
+	// Path matches requests to the given path.
+	Path string `yaml:"path,omitempty"`
+	// Headers matches requests with all of the given header values.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// ExternalLabels matches requests whose series have all of the given labels.
+	// As external labels are the same for all series of a request, only the first series is looked at.
+	ExternalLabels map[string]string `yaml:"external_labels,omitempty"`
+	Pool           string            `yaml:"pool"`
+}
+
+// LoadRoutingConfig reads and validates the routing table in the given file.
+func LoadRoutingConfig(path string) (*RoutingConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	var cfg RoutingConfig
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, errors.Wrapf(err, "parse file %s", path)
+	}
+
+	if len(cfg.Pools) == 0 {
+		return nil, errors.New("no pools configured")
+	}
+
+	pools := map[string]struct{}{}
+
+	for _, p := range cfg.Pools {
+		if p.Name == "" {
+			return nil, errors.New("pool without name")
+		}
+
+		if _, ok := pools[p.Name]; ok {
+			return nil, errors.Errorf("duplicate pool %q", p.Name)
+		}
+
+		pools[p.Name] = struct{}{}
+
+		switch p.Picker {
+		case "", PickerRoundRobin, PickerLeastOutstanding, PickerP2CInFlight, PickerP2CEWMA, PickerWeighted:
+		default:
+			return nil, errors.Errorf("unknown picker %q of pool %q", p.Picker, p.Name)
+		}
+	}
+
+	if len(cfg.Routes) == 0 {
+		return nil, errors.New("no routes configured")
+	}
+
+	for i, r := range cfg.Routes {
+		if _, ok := pools[r.Pool]; !ok {
+			return nil, errors.Errorf("route %d refers to unknown pool %q", i, r.Pool)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// RoutePaths returns the distinct paths the given routes match on.
+func RoutePaths(routes []RouteConfig) []string {
+	var paths []string
+
+	seen := map[string]struct{}{}
+
+	for _, r := range routes {
+		if _, ok := seen[r.Path]; ok || r.Path == "" {
+			continue
+		}
+
+		seen[r.Path] = struct{}{}
+		paths = append(paths, r.Path)
+	}
+
+	return paths
+}
+
+// RouteHeaders returns the distinct names of the headers the given routes match on.
+func RouteHeaders(routes []RouteConfig) []string {
+	var names []string
+
+	seen := map[string]struct{}{}
+
+	for _, r := range routes {
+		for name := range r.Headers {
+			name = http.CanonicalHeaderKey(name)
+			if _, ok := seen[name]; ok {
+				continue
+			}
+
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Router is a http.Handler that hands requests to the handler of the pool of the first route they match.
+// Requests matching no route are answered with 404.
+type Router struct {
+	logger log.Logger
+	routes []RouteConfig
+	pools  map[string]http.Handler
+
+	// matchLabels is set if any route matches on external labels, which requires decoding requests.
+	matchLabels bool
+
+	routed   *prometheus.CounterVec
+	unrouted prometheus.Counter
+}
+
+// NewRouter creates a new router over the given handlers by pool name.
+func NewRouter(logger log.Logger, reg prometheus.Registerer, routes []RouteConfig, pools map[string]http.Handler) *Router {
+	r := &Router{
+		logger: logger,
+		routes: routes,
+		pools:  pools,
+		routed: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "proxy_routed_requests_total",
+				Help: "Tracks the number of requests routed to a pool.",
+			},
+			[]string{"pool"},
+		),
+		unrouted: promauto.With(reg).NewCounter(
+			prometheus.CounterOpts{
+				Name: "proxy_unrouted_requests_total",
+				Help: "Tracks the number of requests that matched no route.",
+			},
+		),
+	}
+
+	for name := range pools {
+		r.routed.WithLabelValues(name)
+	}
+
+	for _, rt := range routes {
+		if len(rt.ExternalLabels) > 0 {
+			r.matchLabels = true
+		}
+	}
+
+	return r
+}
+
+// ServeHTTP implements http.Handler.
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var lbls map[string]string
+
+	if r.matchLabels {
+		enc, err := requestEncoding(req)
+		if err != nil {
+			decodeFailed(w, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		wreq, err := decodeBody(enc, body)
+		if err != nil {
+			level.Debug(r.logger).Log("msg", "failed to decode request", "err", err)
+			decodeFailed(w, err)
+
+			return
+		}
+
+		lbls = map[string]string{}
+
+		if len(wreq.Timeseries) > 0 {
+			for _, l := range wreq.Timeseries[0].Labels {
+				lbls[l.Name] = l.Value
+			}
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	for _, rt := range r.routes {
+		if !matches(req, rt, lbls) {
+			continue
+		}
+
+		r.routed.WithLabelValues(rt.Pool).Inc()
+		trace.SpanFromContext(req.Context()).SetAttributes(kv.String("pool", rt.Pool))
+
+		r.pools[rt.Pool].ServeHTTP(w, req)
+
+		return
+	}
+
+	r.unrouted.Inc()
+	http.Error(w, "no route matched the request", http.StatusNotFound)
+}
+
+// matches returns whether the given request, with the given labels of its first series, matches all matchers of a route.
+func matches(req *http.Request, rt RouteConfig, lbls map[string]string) bool {
+	if len(rt.Tenants) > 0 {
+		tenant := tenancy.FromContext(req.Context())
+		found := false
+
+		for _, t := range rt.Tenants {
+			if t == tenant {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if rt.Path != "" && rt.Path != req.URL.Path {
+		return false
+	}
+
+	for name, value := range rt.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+
+	for name, value := range rt.ExternalLabels {
+		if v, ok := lbls[name]; !ok || v != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+
+	"github.com/kakkoyun/observable-remote-write/internal/compression"
+)
+
+// Transcoder is a http.Handler that re-encodes request bodies in the given content encoding before handing them to
+// the next handler, for example to forward requests compressed with zstd over links between regions.
+// Requests already in the given encoding are handed on as they are.
+type Transcoder struct {
+	next     http.Handler
+	logger   log.Logger
+	tracer   trace.Tracer
+	encoding string
+
+	metrics *compression.Metrics
+}
+
+// NewTranscoder creates a new handler re-encoding request bodies in the given content encoding.
+func NewTranscoder(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, next http.Handler, encoding string) *Transcoder {
+	return &Transcoder{
+		next:     next,
+		logger:   logger,
+		tracer:   tracer,
+		encoding: encoding,
+		metrics:  compression.NewMetrics(prometheus.WrapRegistererWithPrefix("proxy_", reg)),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (t *Transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	enc, err := requestEncoding(r)
+	if err != nil {
+		level.Debug(t.logger).Log("msg", "failed to decode request", "err", err)
+		decodeFailed(w, err)
+
+		return
+	}
+
+	if enc == t.encoding {
+		t.next.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, span := t.tracer.Start(r.Context(), "transcode", trace.WithAttributes(
+		kv.String("from", enc),
+		kv.String("to", t.encoding),
+	))
+
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		http.Error(w, "failed to read request body", http.StatusBadRequest)
+
+		return
+	}
+
+	raw, err := compression.Decode(enc, compressed)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Debug(t.logger).Log("msg", "failed to decode request", "encoding", enc, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	body, err := compression.Encode(t.encoding, raw)
+	if err != nil {
+		span.RecordError(ctx, err)
+		span.End()
+		level.Error(t.logger).Log("msg", "failed to encode request", "encoding", t.encoding, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	t.metrics.Observe(enc, "decode", len(compressed), len(raw))
+	t.metrics.Observe(t.encoding, "encode", len(body), len(raw))
+	span.SetAttributes(kv.Int("bytes_in", len(compressed)), kv.Int("bytes_out", len(body)))
+	span.End()
+
+	r.Header.Set("Content-Encoding", t.encoding)
+	replaceBody(r, body)
+
+	t.next.ServeHTTP(w, r)
+}
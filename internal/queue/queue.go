@@ -0,0 +1,490 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kakkoyun/observable-remote-write/internal"
+	internalhttp "github.com/kakkoyun/observable-remote-write/internal/http"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const (
+	entrySuffix = ".entry"
+	tmpSuffix   = ".tmp"
+
+	reasonExpired  = "expired"
+	reasonRejected = "rejected"
+	reasonCorrupt  = "corrupt"
+)
+
+// Options configures a Queue.
+type Options struct {
+	// MaxSize is the maximum size of all queued payloads in bytes. Requests exceeding it are not queued.
+	MaxSize int64
+	// MaxAge is the age after which queued requests are dropped instead of replayed.
+	MaxAge time.Duration
+	// MinBackoff is the initial time to wait before replaying again after a failure.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum time to wait before replaying again after a failure.
+	MaxBackoff time.Duration
+	// Headers are the names of the headers kept with queued requests in addition to the remote write ones,
+	// like the tenant header and the headers requests are routed by.
+	Headers []string
+}
+
+// keptHeaders are the headers of remote write requests that are kept with queued requests.
+// Other headers, like credentials, are not written to disk.
+var keptHeaders = []string{"Content-Type", "Content-Encoding", "X-Prometheus-Remote-Write-Version", "User-Agent"}
+
+// entryHeader is stored in front of the payload of every queued request.
+// The path and kept headers of the request are restored when it is replayed, so that it is routed like the original one.
+type entryHeader struct {
+	Tenant   string      `json:"tenant"`
+	Path     string      `json:"path"`
+	Header   http.Header `json:"header"`
+	Enqueued time.Time   `json:"enqueued"`
+}
+
+type entry struct {
+	seq      uint64
+	size     int64
+	enqueued time.Time
+}
+
+// Queue is a durable, on-disk first-in first-out queue of remote write requests.
+// It wraps the handler forwarding requests to the targets: requests failing with a server error are fsynced to disk
+// and acknowledged to the client, then replayed in order once the targets recover.
+// While requests are queued, new requests are queued as well, so that the targets receive samples in order.
+type Queue struct {
+	logger log.Logger
+	dir    string
+	next   http.Handler
+	opts   Options
+
+	mtx     sync.Mutex
+	entries []entry
+	size    int64
+	seq     uint64
+	notify  chan struct{}
+
+	enqueued   prometheus.Counter
+	replayed   prometheus.Counter
+	dropped    *prometheus.CounterVec
+	replayLag  prometheus.Histogram
+	failedRuns prometheus.Counter
+}
+
+// New creates a new queue in the given directory in front of the given handler, picking up requests queued by a previous run.
+func New(logger log.Logger, reg prometheus.Registerer, dir string, next http.Handler, opts Options) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrap(err, "create queue directory")
+	}
+
+	q := &Queue{
+		logger: logger,
+		dir:    dir,
+		next:   next,
+		opts:   opts,
+		notify: make(chan struct{}, 1),
+		enqueued: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "proxy_queue_enqueued_requests_total",
+			Help: "Tracks the number of requests written to the queue.",
+		}),
+		replayed: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "proxy_queue_replayed_requests_total",
+			Help: "Tracks the number of queued requests successfully replayed to the targets.",
+		}),
+		dropped: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_queue_dropped_requests_total",
+			Help: "Tracks the number of queued requests dropped without being replayed.",
+		}, []string{"reason"}),
+		replayLag: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Name:    "proxy_queue_replay_lag_seconds",
+			Help:    "Tracks the time between queueing a request and successfully replaying it.",
+			Buckets: []float64{0.1, 1, 5, 15, 30, 60, 300, 900, 1800, 3600, 10800, 21600},
+		}),
+		failedRuns: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "proxy_queue_replay_failures_total",
+			Help: "Tracks the number of replay attempts that failed and were retried after a backoff.",
+		}),
+	}
+
+	for _, reason := range []string{reasonExpired, reasonRejected, reasonCorrupt} {
+		q.dropped.WithLabelValues(reason)
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_queue_length",
+		Help: "The number of requests in the queue.",
+	}, func() float64 {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+
+		return float64(len(q.entries))
+	})
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_queue_size_bytes",
+		Help: "The size of the payloads in the queue.",
+	}, func() float64 {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+
+		return float64(q.size)
+	})
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_queue_oldest_request_age_seconds",
+		Help: "The age of the oldest request in the queue, that is how far replaying lags behind.",
+	}, func() float64 {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+
+		if len(q.entries) == 0 {
+			return 0
+		}
+
+		return time.Since(q.entries[0].enqueued).Seconds()
+	})
+
+	return q, nil
+}
+
+// load indexes the requests queued by a previous run and removes partially written ones.
+func (q *Queue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return errors.Wrap(err, "read queue directory")
+	}
+
+	for _, f := range files {
+		name := f.Name()
+
+		if strings.HasSuffix(name, tmpSuffix) {
+			if err := os.Remove(filepath.Join(q.dir, name)); err != nil {
+				return errors.Wrap(err, "remove partially written entry")
+			}
+
+			continue
+		}
+
+		if !strings.HasSuffix(name, entrySuffix) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, entrySuffix), 10, 64)
+		if err != nil {
+			level.Warn(q.logger).Log("msg", "ignoring unexpected file in queue directory", "file", name)
+			continue
+		}
+
+		q.entries = append(q.entries, entry{seq: seq, size: f.Size(), enqueued: f.ModTime()})
+		q.size += f.Size()
+
+		if seq >= q.seq {
+			q.seq = seq + 1
+		}
+	}
+
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+
+	if len(q.entries) > 0 {
+		level.Info(q.logger).Log("msg", "found queued requests", "requests", len(q.entries), "bytes", q.size)
+	}
+
+	return nil
+}
+
+// ServeHTTP forwards the request to the next handler unless requests are queued.
+// If the queue is not empty or forwarding fails with a server error, the request is queued and acknowledged with 202.
+func (q *Queue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	internal.ExhaustCloseWithLogOnErr(q.logger, r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if q.Len() == 0 {
+		rec := internalhttp.NewRecorder()
+		q.next.ServeHTTP(rec, withBody(r, body))
+
+		if rec.Code/100 != 5 {
+			rec.WriteTo(w)
+			return
+		}
+
+		level.Warn(q.logger).Log("msg", "forwarding failed, queueing request", "code", rec.Code)
+	}
+
+	if err := q.enqueue(r, body); err != nil {
+		level.Error(q.logger).Log("msg", "queue request", "err", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Len returns the number of queued requests.
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return len(q.entries)
+}
+
+// enqueue durably writes the request to the queue.
+func (q *Queue) enqueue(r *http.Request, body []byte) error {
+	h := entryHeader{
+		Tenant:   tenancy.FromContext(r.Context()),
+		Path:     r.URL.Path,
+		Header:   http.Header{},
+		Enqueued: time.Now(),
+	}
+
+	for _, names := range [][]string{keptHeaders, q.opts.Headers} {
+		for _, name := range names {
+			if vs := r.Header.Values(name); len(vs) > 0 {
+				h.Header[http.CanonicalHeaderKey(name)] = vs
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(h); err != nil {
+		return errors.Wrap(err, "encode entry header")
+	}
+
+	buf.Write(body)
+
+	size := int64(buf.Len())
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.opts.MaxSize > 0 && q.size+size > q.opts.MaxSize {
+		return errors.Errorf("queue is full, %d of %d bytes used", q.size, q.opts.MaxSize)
+	}
+
+	seq := q.seq
+	if err := q.write(seq, buf.Bytes()); err != nil {
+		return err
+	}
+
+	q.seq++
+	q.entries = append(q.entries, entry{seq: seq, size: size, enqueued: h.Enqueued})
+	q.size += size
+	q.enqueued.Inc()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// write writes and fsyncs the entry with the given sequence number, so that it is either complete on disk or absent.
+func (q *Queue) write(seq uint64, b []byte) error {
+	path := q.path(seq)
+
+	f, err := os.OpenFile(path+tmpSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return errors.Wrap(err, "create entry")
+	}
+
+	if _, err := f.Write(b); err != nil {
+		internal.CloseWithLogOnErr(q.logger, f)
+		return errors.Wrap(err, "write entry")
+	}
+
+	if err := f.Sync(); err != nil {
+		internal.CloseWithLogOnErr(q.logger, f)
+		return errors.Wrap(err, "sync entry")
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close entry")
+	}
+
+	if err := os.Rename(path+tmpSuffix, path); err != nil {
+		return errors.Wrap(err, "rename entry")
+	}
+
+	d, err := os.Open(q.dir)
+	if err != nil {
+		return errors.Wrap(err, "open queue directory")
+	}
+
+	defer internal.CloseWithLogOnErr(q.logger, d)
+
+	return errors.Wrap(d.Sync(), "sync queue directory")
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, entrySuffix))
+}
+
+// Run replays queued requests in order until the given context is canceled.
+// After a failed replay it backs off exponentially between the configured minimum and maximum.
+func (q *Queue) Run(ctx context.Context) error {
+	backoff := q.opts.MinBackoff
+
+	for {
+		q.mtx.Lock()
+		var (
+			head  entry
+			empty = len(q.entries) == 0
+		)
+		if !empty {
+			head = q.entries[0]
+		}
+		q.mtx.Unlock()
+
+		if empty {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-q.notify:
+				continue
+			}
+		}
+
+		if err := q.replay(ctx, head); err != nil {
+			q.failedRuns.Inc()
+			level.Warn(q.logger).Log("msg", "replay queued request", "backoff", backoff, "err", err)
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > q.opts.MaxBackoff {
+				backoff = q.opts.MaxBackoff
+			}
+
+			continue
+		}
+
+		backoff = q.opts.MinBackoff
+	}
+}
+
+// replay forwards the given entry to the next handler and removes it from the queue unless it has to be retried.
+func (q *Queue) replay(ctx context.Context, e entry) error {
+	if q.opts.MaxAge > 0 && time.Since(e.enqueued) > q.opts.MaxAge {
+		level.Warn(q.logger).Log("msg", "dropping expired queued request", "enqueued", e.enqueued)
+		return q.remove(e, reasonExpired)
+	}
+
+	f, err := os.Open(q.path(e.seq))
+	if err != nil {
+		return errors.Wrap(err, "open entry")
+	}
+
+	defer internal.CloseWithLogOnErr(q.logger, f)
+
+	var (
+		br = bufio.NewReader(f)
+		h  entryHeader
+	)
+
+	line, err := br.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &h)
+	}
+
+	if err != nil {
+		level.Error(q.logger).Log("msg", "dropping corrupt queued request", "err", err)
+		return q.remove(e, reasonCorrupt)
+	}
+
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		return errors.Wrap(err, "read entry")
+	}
+
+	r, err := http.NewRequestWithContext(tenancy.NewContext(ctx, h.Tenant), http.MethodPost, h.Path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+
+	for name, vs := range h.Header {
+		r.Header[name] = vs
+	}
+
+	rec := internalhttp.NewRecorder()
+	q.next.ServeHTTP(rec, r)
+
+	switch {
+	case retryable(rec):
+		return errors.Errorf("server returned HTTP status %d: %s", rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+	case rec.Code/100 != 2:
+		level.Warn(q.logger).Log("msg", "dropping queued request rejected by targets", "code", rec.Code, "err", bytes.TrimSpace(rec.Body.Bytes()))
+		return q.remove(e, reasonRejected)
+	}
+
+	q.replayLag.Observe(time.Since(h.Enqueued).Seconds())
+	q.replayed.Inc()
+
+	return q.remove(e, "")
+}
+
+// retryable returns whether a replayed request has to be replayed again: after server errors, rate limiting
+// and any other response asking to retry later with Retry-After.
+func retryable(rec *internalhttp.Recorder) bool {
+	return rec.Code/100 == 5 || rec.Code == http.StatusTooManyRequests || rec.Header().Get("Retry-After") != ""
+}
+
+// remove deletes the given head entry from the queue, counting it as dropped for the given reason if not empty.
+func (q *Queue) remove(e entry, reason string) error {
+	if err := os.Remove(q.path(e.seq)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove entry")
+	}
+
+	if reason != "" {
+		q.dropped.WithLabelValues(reason).Inc()
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.entries = q.entries[1:]
+	q.size -= e.size
+
+	return nil
+}
+
+// withBody returns a shallow copy of the request reading the given body.
+func withBody(r *http.Request, body []byte) *http.Request {
+	r = r.Clone(r.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return r
+}
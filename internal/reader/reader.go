@@ -0,0 +1,202 @@
+package reader
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/gate"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	"go.opentelemetry.io/otel/api/trace"
+)
+
+// Options configures the limits of the remote read handler.
+type Options struct {
+	// SampleLimit is the maximum number of samples to return per query in a sampled response, 0 means no limit.
+	SampleLimit int
+	// ConcurrencyLimit is the maximum number of concurrently served read requests.
+	ConcurrencyLimit int
+	// MaxBytesInFrame is the maximum size of a single frame in a streamed response.
+	MaxBytesInFrame int
+}
+
+// Read returns an HTTP handler that answers Prometheus remote read requests from the given queryable.
+// Both sampled and streamed chunked responses are supported, whichever the client accepts first.
+func Read(logger log.Logger, tracer trace.Tracer, queryable storage.Queryable, opts Options) http.HandlerFunc {
+	g := gate.New(opts.ConcurrencyLimit)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracer.Start(r.Context(), "read")
+		defer span.End()
+
+		if err := g.Start(ctx); err != nil {
+			level.Warn(logger).Log("msg", "wait for read gate", "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+
+			return
+		}
+		defer g.Done()
+
+		var req *prompb.ReadRequest
+
+		if err := tracer.WithSpan(ctx, "decode", func(ctx context.Context) error {
+			var err error
+			req, err = remote.DecodeReadRequest(r)
+			return err
+		}); err != nil {
+			level.Warn(logger).Log("msg", "decode read request", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		responseType, err := remote.NegotiateResponseType(req.AcceptedResponseTypes)
+		if err != nil {
+			level.Warn(logger).Log("msg", "negotiate response type", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		switch responseType {
+		case prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			err = tracer.WithSpan(ctx, "stream", func(ctx context.Context) error {
+				return readStreamed(ctx, logger, w, queryable, req, opts.MaxBytesInFrame)
+			})
+		default:
+			err = tracer.WithSpan(ctx, "sample", func(ctx context.Context) error {
+				return readSamples(ctx, logger, w, queryable, req, opts.SampleLimit)
+			})
+		}
+
+		if err != nil {
+			level.Warn(logger).Log("msg", "remote read", "type", responseType, "err", err)
+
+			var httpErr remote.HTTPError
+			if errors.As(err, &httpErr) {
+				http.Error(w, httpErr.Error(), httpErr.Status())
+				return
+			}
+
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+	}
+}
+
+func readSamples(ctx context.Context, logger log.Logger, w http.ResponseWriter, queryable storage.Queryable, req *prompb.ReadRequest, sampleLimit int) error {
+	resp := prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+
+	for i, query := range req.Queries {
+		if err := func() error {
+			matchers, err := remote.FromLabelMatchers(query.Matchers)
+			if err != nil {
+				return err
+			}
+
+			q, err := queryable.Querier(ctx, query.StartTimestampMs, query.EndTimestampMs)
+			if err != nil {
+				return err
+			}
+			defer closeQuerier(logger, q)
+
+			res, ws, err := remote.ToQueryResult(q.Select(false, selectHints(query.Hints), matchers...), sampleLimit)
+			if err != nil {
+				return err
+			}
+
+			logWarnings(logger, ws)
+
+			resp.Results[i] = res
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+
+	return remote.EncodeReadResponse(&resp, w)
+}
+
+func readStreamed(ctx context.Context, logger log.Logger, w http.ResponseWriter, queryable storage.Queryable, req *prompb.ReadRequest, maxBytesInFrame int) error {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("response writer does not implement http.Flusher")
+	}
+
+	w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+
+	for i, query := range req.Queries {
+		if err := func() error {
+			matchers, err := remote.FromLabelMatchers(query.Matchers)
+			if err != nil {
+				return err
+			}
+
+			q, err := queryable.Querier(ctx, query.StartTimestampMs, query.EndTimestampMs)
+			if err != nil {
+				return err
+			}
+			defer closeQuerier(logger, q)
+
+			// TSDB does not implement a chunk querier yet, so samples are re-encoded into chunks.
+			ws, err := remote.DeprecatedStreamChunkedReadResponses(
+				remote.NewChunkedWriter(w, f),
+				int64(i),
+				// The streaming API has to provide the series sorted.
+				q.Select(true, selectHints(query.Hints), matchers...),
+				nil,
+				maxBytesInFrame,
+			)
+			if err != nil {
+				return err
+			}
+
+			logWarnings(logger, ws)
+
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func selectHints(h *prompb.ReadHints) *storage.SelectHints {
+	if h == nil {
+		return nil
+	}
+
+	return &storage.SelectHints{
+		Start:    h.StartMs,
+		End:      h.EndMs,
+		Step:     h.StepMs,
+		Func:     h.Func,
+		Grouping: h.Grouping,
+		By:       h.By,
+		Range:    h.RangeMs,
+	}
+}
+
+func closeQuerier(logger log.Logger, q storage.Querier) {
+	if err := q.Close(); err != nil {
+		level.Warn(logger).Log("msg", "close querier", "err", err)
+	}
+}
+
+func logWarnings(logger log.Logger, ws storage.Warnings) {
+	for _, w := range ws {
+		level.Warn(logger).Log("msg", "remote read query", "warning", w)
+	}
+}
@@ -0,0 +1,57 @@
+package receiver
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// statusError is an error that carries the HTTP status code a rejected request is answered with.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// BadRequest marks the given error as caused by invalid data.
+// Such requests are answered with 400 and Prometheus will not retry them.
+func BadRequest(err error) error {
+	return &statusError{code: http.StatusBadRequest, err: err}
+}
+
+// TooManyRequests marks the given error as caused by exceeding a limit.
+// Such requests are answered with 429, so that Prometheus backs off.
+func TooManyRequests(err error) error {
+	return &statusError{code: http.StatusTooManyRequests, err: err}
+}
+
+// Accepted marks the given error as caused by data that was deliberately not stored, like samples of a standby replica.
+// Such requests are answered with 202, so that Prometheus considers them sent.
+func Accepted(err error) error {
+	return &statusError{code: http.StatusAccepted, err: err}
+}
+
+// statusCode returns the HTTP status code to answer a failed append with.
+// Unless an appender marked the error otherwise, failures are considered retryable.
+func statusCode(err error) int {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.code
+	}
+
+	switch errors.Cause(err) {
+	case storage.ErrOutOfOrderSample, storage.ErrDuplicateSampleForTimestamp, storage.ErrOutOfBounds:
+		// Retrying samples rejected by the storage will not make them acceptable.
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
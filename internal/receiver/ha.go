@@ -0,0 +1,176 @@
+package receiver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// HAOptions configures a HATracker.
+type HAOptions struct {
+	// ClusterLabel is the label identifying the HA cluster a series was scraped by.
+	ClusterLabel string
+	// ReplicaLabel is the label identifying the replica of the HA cluster a series was scraped by.
+	ReplicaLabel string
+	// FailoverTimeout is the time without requests from the elected replica after which another replica is elected.
+	FailoverTimeout time.Duration
+}
+
+type electedReplica struct {
+	replica    string
+	receivedAt time.Time
+}
+
+// HATracker is an appender that deduplicates requests of HA pairs of Prometheus servers.
+// For every cluster of a tenant, it elects the replica it received a request from first and only accepts requests
+// from that replica. If the elected replica sends no requests for the failover timeout, the next replica
+// to send a request is elected. Accepted requests are handed to the next appender without the replica label.
+//
+// As the cluster and replica labels are external labels, they are the same for all series of a request,
+// so only the first series is looked at. Requests without both labels are handed on as they are.
+type HATracker struct {
+	next   Appender
+	logger log.Logger
+	opts   HAOptions
+
+	mtx     sync.Mutex
+	elected map[string]map[string]*electedReplica
+
+	deduplicated *prometheus.CounterVec
+	changes      *prometheus.CounterVec
+	lastSeen     *prometheus.GaugeVec
+}
+
+// NewHATracker creates a new appender that deduplicates HA pairs before appending to the given appender.
+func NewHATracker(next Appender, logger log.Logger, reg prometheus.Registerer, opts HAOptions) *HATracker {
+	return &HATracker{
+		next:    next,
+		logger:  logger,
+		opts:    opts,
+		elected: map[string]map[string]*electedReplica{},
+		deduplicated: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_ha_deduplicated_samples_total",
+				Help: "Tracks the number of samples dropped, as they were sent by a replica that is not elected.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		changes: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_ha_elected_replica_changes_total",
+				Help: "Tracks the number of times the elected replica of a cluster changed.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+		lastSeen: promauto.With(reg).NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "receiver_ha_elected_replica_last_seen_timestamp_seconds",
+				Help: "The time of the last request received from the elected replica of a cluster.",
+			},
+			[]string{"tenant", "cluster"},
+		),
+	}
+}
+
+// Append hands the request to the next appender if it was sent by the elected replica of its cluster,
+// and rejects it with an accepted error otherwise.
+func (t *HATracker) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	if len(req.Timeseries) == 0 {
+		return t.next.Append(ctx, req)
+	}
+
+	cluster, replica := labelValue(req.Timeseries[0].Labels, t.opts.ClusterLabel), labelValue(req.Timeseries[0].Labels, t.opts.ReplicaLabel)
+	if cluster == "" || replica == "" {
+		return t.next.Append(ctx, req)
+	}
+
+	tenant := tenancy.FromContext(ctx)
+
+	if !t.accept(tenant, cluster, replica, time.Now()) {
+		samples := 0
+		for _, ts := range req.Timeseries {
+			samples += len(ts.Samples)
+		}
+
+		t.deduplicated.WithLabelValues(tenant, cluster).Add(float64(samples))
+
+		return Accepted(errors.Errorf("replica %q of cluster %q is not elected, dropped %d samples", replica, cluster, samples))
+	}
+
+	r := *req
+	r.Timeseries = make([]prompb.TimeSeries, 0, len(req.Timeseries))
+
+	for _, ts := range req.Timeseries {
+		ts.Labels = withoutLabel(ts.Labels, t.opts.ReplicaLabel)
+		r.Timeseries = append(r.Timeseries, ts)
+	}
+
+	return t.next.Append(ctx, &r)
+}
+
+// accept returns whether a request from the given replica is accepted, electing it if needed.
+func (t *HATracker) accept(tenant, cluster, replica string, now time.Time) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	clusters, ok := t.elected[tenant]
+	if !ok {
+		clusters = map[string]*electedReplica{}
+		t.elected[tenant] = clusters
+	}
+
+	e, ok := clusters[cluster]
+
+	switch {
+	case !ok:
+		e = &electedReplica{replica: replica}
+		clusters[cluster] = e
+
+		level.Info(t.logger).Log("msg", "elected replica", "tenant", tenant, "cluster", cluster, "replica", replica)
+	case e.replica == replica:
+	case now.Sub(e.receivedAt) > t.opts.FailoverTimeout:
+		level.Warn(t.logger).Log("msg", "elected replica timed out, failing over",
+			"tenant", tenant, "cluster", cluster, "from", e.replica, "to", replica, "last_seen", e.receivedAt)
+
+		e.replica = replica
+		t.changes.WithLabelValues(tenant, cluster).Inc()
+	default:
+		return false
+	}
+
+	e.receivedAt = now
+	t.lastSeen.WithLabelValues(tenant, cluster).Set(float64(now.UnixNano()) / 1e9)
+
+	return true
+}
+
+// labelValue returns the value of the label with the given name, or an empty string.
+func labelValue(ls []prompb.Label, name string) string {
+	for _, l := range ls {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+
+	return ""
+}
+
+// withoutLabel returns the given labels without the label with the given name. The given labels are not modified.
+func withoutLabel(ls []prompb.Label, name string) []prompb.Label {
+	for i, l := range ls {
+		if l.Name == name {
+			return append(append(make([]prompb.Label, 0, len(ls)-1), ls[:i]...), ls[i+1:]...)
+		}
+	}
+
+	return ls
+}
@@ -0,0 +1,144 @@
+package receiver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+	"golang.org/x/time/rate"
+
+	"github.com/kakkoyun/observable-remote-write/internal/limits"
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+const (
+	reasonSamplesPerRequest   = "max_samples_per_request"
+	reasonSeriesPerRequest    = "max_series_per_request"
+	reasonLabelNamesPerSeries = "max_label_names_per_series"
+	reasonLabelNameLength     = "max_label_name_length"
+	reasonLabelValueLength    = "max_label_value_length"
+	reasonRateLimited         = "rate_limited"
+	reasonIngestionBurst      = "ingestion_burst"
+)
+
+// Limiter is an appender that enforces the ingestion limits of the tenant in context
+// before handing the request to the next appender.
+type Limiter struct {
+	next Appender
+	cfg  *limits.Config
+
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+
+	limited *prometheus.CounterVec
+}
+
+// NewLimiter creates a new appender that enforces the given limits before appending to the given appender.
+func NewLimiter(next Appender, reg prometheus.Registerer, cfg *limits.Config) *Limiter {
+	return &Limiter{
+		next:     next,
+		cfg:      cfg,
+		limiters: map[string]*rate.Limiter{},
+		limited: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_limited_requests_total",
+				Help: "Tracks the number of requests rejected for exceeding ingestion limits.",
+			},
+			[]string{"reason", "tenant"},
+		),
+	}
+}
+
+// Append rejects the whole request with a too many requests error if it exceeds the ingestion rate of its tenant.
+// Requests exceeding a size limit or of more samples than the ingestion burst are rejected as bad requests,
+// as they could never be accepted.
+func (l *Limiter) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	tenant := tenancy.FromContext(ctx)
+	lim := l.cfg.ForTenant(tenant)
+
+	if reason, err := checkRequest(lim, req); err != nil {
+		l.limited.WithLabelValues(reason, tenant).Inc()
+		return BadRequest(err)
+	}
+
+	if lim.IngestionRate > 0 {
+		samples := 0
+		for _, ts := range req.Timeseries {
+			samples += len(ts.Samples)
+		}
+
+		// Requests larger than the burst would never be allowed, so retrying them is pointless.
+		if samples > lim.IngestionBurst {
+			l.limited.WithLabelValues(reasonIngestionBurst, tenant).Inc()
+			return BadRequest(errors.Errorf("request has %d samples, more than the ingestion burst of %d", samples, lim.IngestionBurst))
+		}
+
+		if !l.rateLimiter(tenant, lim).AllowN(time.Now(), samples) {
+			l.limited.WithLabelValues(reasonRateLimited, tenant).Inc()
+			return TooManyRequests(errors.Errorf("ingestion rate limit of %v samples/s with burst %d exceeded by %d samples", lim.IngestionRate, lim.IngestionBurst, samples))
+		}
+	}
+
+	return l.next.Append(ctx, req)
+}
+
+// rateLimiter returns the rate limiter of the given tenant, updating it if its limits changed.
+func (l *Limiter) rateLimiter(tenant string, lim limits.Limits) *rate.Limiter {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	rl, ok := l.limiters[tenant]
+	if !ok {
+		rl = rate.NewLimiter(rate.Limit(lim.IngestionRate), lim.IngestionBurst)
+		l.limiters[tenant] = rl
+
+		return rl
+	}
+
+	if rl.Limit() != rate.Limit(lim.IngestionRate) {
+		rl.SetLimit(rate.Limit(lim.IngestionRate))
+	}
+
+	if rl.Burst() != lim.IngestionBurst {
+		rl.SetBurst(lim.IngestionBurst)
+	}
+
+	return rl
+}
+
+// checkRequest checks the size limits of the given request, returning the reason and the error of the first violation.
+func checkRequest(lim limits.Limits, req *prompb.WriteRequest) (string, error) {
+	if lim.MaxSeriesPerRequest > 0 && len(req.Timeseries) > lim.MaxSeriesPerRequest {
+		return reasonSeriesPerRequest, errors.Errorf("request has %d series, limit is %d", len(req.Timeseries), lim.MaxSeriesPerRequest)
+	}
+
+	samples := 0
+
+	for _, ts := range req.Timeseries {
+		samples += len(ts.Samples)
+
+		if lim.MaxLabelNamesPerSeries > 0 && len(ts.Labels) > lim.MaxLabelNamesPerSeries {
+			return reasonLabelNamesPerSeries, errors.Errorf("series %s has %d label names, limit is %d", seriesString(ts.Labels), len(ts.Labels), lim.MaxLabelNamesPerSeries)
+		}
+
+		for _, lbl := range ts.Labels {
+			if lim.MaxLabelNameLength > 0 && len(lbl.Name) > lim.MaxLabelNameLength {
+				return reasonLabelNameLength, errors.Errorf("label name %q of series %s is longer than %d", lbl.Name, seriesString(ts.Labels), lim.MaxLabelNameLength)
+			}
+
+			if lim.MaxLabelValueLength > 0 && len(lbl.Value) > lim.MaxLabelValueLength {
+				return reasonLabelValueLength, errors.Errorf("value of label %q of series %s is longer than %d", lbl.Name, seriesString(ts.Labels), lim.MaxLabelValueLength)
+			}
+		}
+	}
+
+	if lim.MaxSamplesPerRequest > 0 && samples > lim.MaxSamplesPerRequest {
+		return reasonSamplesPerRequest, errors.Errorf("request has %d samples, limit is %d", samples, lim.MaxSamplesPerRequest)
+	}
+
+	return "", nil
+}
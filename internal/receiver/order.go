@@ -0,0 +1,278 @@
+package receiver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/prompb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// Policy decides what happens to samples that are out of order or duplicates.
+type Policy string
+
+const (
+	// PolicyReject drops the offending samples and answers the request with 400.
+	PolicyReject Policy = "reject"
+	// PolicyDrop drops the offending samples silently.
+	PolicyDrop Policy = "drop"
+	// PolicyAccept hands the offending samples to the next appender regardless.
+	PolicyAccept Policy = "accept"
+)
+
+const (
+	reasonOutOfOrder              = "out_of_order"
+	reasonDuplicateTimestamp      = "duplicate_timestamp"
+	reasonDuplicateDifferentValue = "duplicate_different_value"
+)
+
+// ParsePolicy parses the given policy name.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case PolicyReject, PolicyDrop, PolicyAccept:
+		return p, nil
+	default:
+		return "", errors.Errorf("unknown policy %q", s)
+	}
+}
+
+// OrderPolicies configures the policy for each kind of detected sample.
+type OrderPolicies struct {
+	// OutOfOrder applies to samples older than the last sample of their series.
+	OutOfOrder Policy
+	// Duplicate applies to samples with the same timestamp and value as the last sample of their series.
+	Duplicate Policy
+	// DuplicateDifferentValue applies to samples with the same timestamp but a different value than the last sample of their series.
+	DuplicateDifferentValue Policy
+}
+
+type lastSample struct {
+	t       int64
+	v       float64
+	updated time.Time
+}
+
+// OrderChecker is an appender that tracks the last sample of each series
+// and detects out-of-order and duplicate samples before handing the request to the next appender.
+type OrderChecker struct {
+	next     Appender
+	policies OrderPolicies
+	ttl      time.Duration
+
+	mtx    sync.Mutex
+	series map[string]lastSample
+	lastGC time.Time
+
+	samples *prometheus.CounterVec
+	tracked prometheus.Gauge
+}
+
+// NewOrderChecker creates a new appender that checks sample order before appending to the given appender.
+// Series that did not receive samples for the given ttl are forgotten.
+func NewOrderChecker(next Appender, reg prometheus.Registerer, policies OrderPolicies, ttl time.Duration) *OrderChecker {
+	c := &OrderChecker{
+		next:     next,
+		policies: policies,
+		ttl:      ttl,
+		series:   map[string]lastSample{},
+		lastGC:   time.Now(),
+		samples: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_out_of_order_samples_total",
+				Help: "Tracks the number of out-of-order and duplicate samples detected, by the policy applied to them.",
+			},
+			[]string{"reason", "policy"},
+		),
+		tracked: promauto.With(reg).NewGauge(
+			prometheus.GaugeOpts{
+				Name: "receiver_order_tracked_series",
+				Help: "The number of series the last sample is tracked for.",
+			},
+		),
+	}
+
+	for reason, policy := range map[string]Policy{
+		reasonOutOfOrder:              policies.OutOfOrder,
+		reasonDuplicateTimestamp:      policies.Duplicate,
+		reasonDuplicateDifferentValue: policies.DuplicateDifferentValue,
+	} {
+		c.samples.WithLabelValues(reason, string(policy))
+	}
+
+	return c
+}
+
+// Append checks every sample against the last sample of its series and applies the configured policies.
+// The tracked samples only advance once the next appender succeeded, so that retried requests are not mistaken for duplicates.
+func (c *OrderChecker) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	var (
+		now      = time.Now()
+		tenant   = tenancy.FromContext(ctx)
+		pending  = make(map[string]lastSample, len(req.Timeseries))
+		filtered []prompb.TimeSeries
+		firstErr error
+	)
+
+	c.mtx.Lock()
+
+	for i, ts := range req.Timeseries {
+		key := seriesKey(tenant, ts.Labels)
+
+		last, ok := pending[key]
+		if !ok {
+			last, ok = c.series[key]
+		}
+
+		var kept []prompb.Sample
+
+		for j, s := range ts.Samples {
+			reason, policy := c.check(ok, last, s)
+			if reason != "" {
+				c.samples.WithLabelValues(reason, string(policy)).Inc()
+			}
+
+			if policy == PolicyReject && firstErr == nil {
+				firstErr = errors.Errorf("%s sample for series %s at %d", strings.ReplaceAll(reason, "_", " "), seriesString(ts.Labels), s.Timestamp)
+			}
+
+			if reason == "" || policy == PolicyAccept {
+				if kept != nil {
+					kept = append(kept, s)
+				}
+
+				if !ok || s.Timestamp >= last.t {
+					last, ok = lastSample{t: s.Timestamp, v: s.Value, updated: now}, true
+				}
+
+				continue
+			}
+
+			if kept == nil {
+				kept = append(make([]prompb.Sample, 0, len(ts.Samples)), ts.Samples[:j]...)
+			}
+		}
+
+		if ok {
+			pending[key] = last
+		}
+
+		if kept != nil && filtered == nil {
+			filtered = append(make([]prompb.TimeSeries, 0, len(req.Timeseries)), req.Timeseries[:i]...)
+		}
+
+		if filtered != nil {
+			if kept != nil {
+				ts.Samples = kept
+			}
+
+			if len(ts.Samples) > 0 {
+				filtered = append(filtered, ts)
+			}
+		}
+	}
+
+	c.mtx.Unlock()
+
+	if filtered != nil {
+		r := *req
+		r.Timeseries = filtered
+		req = &r
+	}
+
+	if err := c.next.Append(ctx, req); err != nil {
+		return err
+	}
+
+	c.commit(now, pending)
+
+	if firstErr != nil {
+		return BadRequest(firstErr)
+	}
+
+	return nil
+}
+
+// check returns the reason and the policy that applies to the given sample, or an empty reason if it is in order.
+func (c *OrderChecker) check(tracked bool, last lastSample, s prompb.Sample) (string, Policy) {
+	switch {
+	case !tracked || s.Timestamp > last.t:
+		return "", ""
+	case s.Timestamp < last.t:
+		return reasonOutOfOrder, c.policies.OutOfOrder
+	case s.Value == last.v:
+		return reasonDuplicateTimestamp, c.policies.Duplicate
+	default:
+		return reasonDuplicateDifferentValue, c.policies.DuplicateDifferentValue
+	}
+}
+
+// commit advances the tracked samples and forgets series that exceeded the ttl.
+func (c *OrderChecker) commit(now time.Time, pending map[string]lastSample) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for key, s := range pending {
+		if last, ok := c.series[key]; ok && last.t > s.t {
+			continue
+		}
+
+		c.series[key] = s
+	}
+
+	if now.Sub(c.lastGC) >= c.ttl {
+		for key, s := range c.series {
+			if now.Sub(s.updated) >= c.ttl {
+				delete(c.series, key)
+			}
+		}
+
+		c.lastGC = now
+	}
+
+	c.tracked.Set(float64(len(c.series)))
+}
+
+// seriesKey returns a unique key for the given tenant and sorted labels.
+func seriesKey(tenant string, ls []prompb.Label) string {
+	var b strings.Builder
+
+	b.WriteString(tenant)
+	b.WriteByte('\xff')
+
+	for _, l := range ls {
+		b.WriteString(l.Name)
+		b.WriteByte('\xff')
+		b.WriteString(l.Value)
+		b.WriteByte('\xff')
+	}
+
+	return b.String()
+}
+
+// seriesString formats the given labels the same way Prometheus formats label sets.
+func seriesString(ls []prompb.Label) string {
+	var b strings.Builder
+
+	b.WriteByte('{')
+
+	for i, l := range ls {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+
+		b.WriteString(l.Name)
+		b.WriteString(`="`)
+		b.WriteString(l.Value)
+		b.WriteByte('"')
+	}
+
+	b.WriteByte('}')
+
+	return b.String()
+}
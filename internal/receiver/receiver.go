@@ -2,26 +2,51 @@ package receiver
 
 import (
 	"context"
-	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/gogo/protobuf/proto"
-	"github.com/golang/snappy"
-	"github.com/prometheus/common/model"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/api/kv"
 	"go.opentelemetry.io/otel/api/trace"
 
 	"github.com/kakkoyun/observable-remote-write/internal"
+	"github.com/kakkoyun/observable-remote-write/internal/compression"
 )
 
-func Receive(logger log.Logger, tracer trace.Tracer) http.HandlerFunc {
+// Appender is the interface that wraps the basic Append method.
+//
+// Append hands the decoded remote write request over to an underlying storage.
+// Implementations must not retain the request after returning.
+type Appender interface {
+	Append(ctx context.Context, req *prompb.WriteRequest) error
+}
+
+// Receive returns an HTTP handler that decodes Prometheus remote write requests and hands them to the given appender.
+// Bodies are decoded according to their Content-Encoding; requests of unsupported encodings are answered with 415.
+// Append errors are answered with 5xx, so that Prometheus retries them, unless the appender marked them as non-retryable.
+func Receive(logger log.Logger, tracer trace.Tracer, reg prometheus.Registerer, app Appender) http.HandlerFunc {
+	metrics := compression.NewMetrics(prometheus.WrapRegistererWithPrefix("receiver_", reg))
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, span := tracer.Start(r.Context(), "receive")
 		defer span.End()
 
+		enc, err := compression.Parse(r.Header.Get("Content-Encoding"))
+		if err != nil {
+			level.Warn(logger).Log("msg", "content encoding", "err", err)
+			w.Header().Set("Accept-Encoding", strings.Join(compression.Encodings, ", "))
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+
+			return
+		}
+
+		span.SetAttributes(kv.String("encoding", enc))
+
 		var compressed []byte
 
 		if err := tracer.WithSpan(ctx, "read", func(ctx context.Context) error {
@@ -41,15 +66,17 @@ func Receive(logger log.Logger, tracer trace.Tracer) http.HandlerFunc {
 
 		if err := tracer.WithSpan(ctx, "decode", func(ctx context.Context) error {
 			var err error
-			reqBuf, err = snappy.Decode(nil, compressed)
+			reqBuf, err = compression.Decode(enc, compressed)
 			return err
 		}); err != nil {
-			level.Warn(logger).Log("msg", "snappy decode", "err", err)
+			level.Warn(logger).Log("msg", "decode", "encoding", enc, "err", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 
 			return
 		}
 
+		metrics.Observe(enc, "decode", len(compressed), len(reqBuf))
+
 		var req prompb.WriteRequest
 
 		if err := tracer.WithSpan(ctx, "decode", func(ctx context.Context) error {
@@ -63,17 +90,20 @@ func Receive(logger log.Logger, tracer trace.Tracer) http.HandlerFunc {
 
 		level.Info(logger).Log("msg", "remote write request received")
 
-		for _, ts := range req.Timeseries {
-			m := make(model.Metric, len(ts.Labels))
-			for _, l := range ts.Labels {
-				m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		if err := tracer.WithSpan(ctx, "append", func(ctx context.Context) error {
+			return app.Append(ctx, &req)
+		}); err != nil {
+			code := statusCode(err)
+
+			lvl := level.Warn
+			if code/100 == 2 {
+				lvl = level.Debug
 			}
 
-			level.Debug(logger).Log("msg", m)
+			lvl(logger).Log("msg", "append", "code", code, "err", err)
+			http.Error(w, err.Error(), code)
 
-			for _, s := range ts.Samples {
-				level.Debug(logger).Log("msg", fmt.Sprintf("  %f %d", s.Value, s.Timestamp))
-			}
+			return
 		}
 	}
 }
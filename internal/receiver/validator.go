@@ -0,0 +1,138 @@
+package receiver
+
+import (
+	"context"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	reasonMissingMetricName  = "missing_metric_name"
+	reasonInvalidMetricName  = "invalid_metric_name"
+	reasonInvalidLabelName   = "invalid_label_name"
+	reasonInvalidLabelValue  = "invalid_label_value"
+	reasonEmptyLabelValue    = "empty_label_value"
+	reasonUnsortedLabels     = "unsorted_labels"
+	reasonDuplicateLabelName = "duplicate_label_name"
+)
+
+// Validator is an appender that rejects invalid series before handing the rest of the request to the next appender.
+type Validator struct {
+	next Appender
+
+	invalidSeries *prometheus.CounterVec
+}
+
+// NewValidator creates a new appender that validates series before appending them to the given appender.
+func NewValidator(next Appender, reg prometheus.Registerer) *Validator {
+	v := &Validator{
+		next: next,
+		invalidSeries: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "receiver_invalid_series_total",
+				Help: "Tracks the number of series rejected by validation.",
+			},
+			[]string{"reason"},
+		),
+	}
+
+	for _, reason := range []string{
+		reasonMissingMetricName,
+		reasonInvalidMetricName,
+		reasonInvalidLabelName,
+		reasonInvalidLabelValue,
+		reasonEmptyLabelValue,
+		reasonUnsortedLabels,
+		reasonDuplicateLabelName,
+	} {
+		v.invalidSeries.WithLabelValues(reason)
+	}
+
+	return v
+}
+
+// Append appends all valid series of the given request.
+// If any series is invalid, the rest of the request is still appended but a bad request error is returned for the first invalid one.
+// Storage errors take precedence, as they are retryable.
+func (v *Validator) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	var (
+		valid    = req.Timeseries[:0:0]
+		firstErr error
+	)
+
+	for _, ts := range req.Timeseries {
+		reason, err := validateLabels(ts.Labels)
+		if err != nil {
+			v.invalidSeries.WithLabelValues(reason).Inc()
+
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		valid = append(valid, ts)
+	}
+
+	if firstErr == nil {
+		return v.next.Append(ctx, req)
+	}
+
+	filtered := *req
+	filtered.Timeseries = valid
+
+	if err := v.next.Append(ctx, &filtered); err != nil {
+		return err
+	}
+
+	return BadRequest(firstErr)
+}
+
+// validateLabels checks the labels of a single series, returning the reason and the error of the first violation.
+func validateLabels(ls []prompb.Label) (string, error) {
+	var hasName bool
+
+	for i, l := range ls {
+		if l.Name == labels.MetricName {
+			hasName = true
+
+			if !model.IsValidMetricName(model.LabelValue(l.Value)) {
+				return reasonInvalidMetricName, errors.Errorf("invalid metric name %q", l.Value)
+			}
+		}
+
+		if !model.LabelName(l.Name).IsValid() {
+			return reasonInvalidLabelName, errors.Errorf("invalid label name %q", l.Name)
+		}
+
+		if l.Value == "" {
+			return reasonEmptyLabelValue, errors.Errorf("empty value for label %q", l.Name)
+		}
+
+		if !utf8.ValidString(l.Value) {
+			return reasonInvalidLabelValue, errors.Errorf("invalid UTF-8 in value of label %q", l.Name)
+		}
+
+		if i > 0 {
+			switch prev := ls[i-1].Name; {
+			case prev == l.Name:
+				return reasonDuplicateLabelName, errors.Errorf("duplicate label name %q", l.Name)
+			case prev > l.Name:
+				return reasonUnsortedLabels, errors.Errorf("labels are not sorted, %q comes after %q", l.Name, prev)
+			}
+		}
+	}
+
+	if !hasName {
+		return reasonMissingMetricName, errors.New("missing metric name")
+	}
+
+	return "", nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// LogAppender is an appender that only logs received series and samples, nothing is kept.
+type LogAppender struct {
+	logger log.Logger
+}
+
+// NewLogAppender creates a new appender that logs series and samples in debug level.
+func NewLogAppender(logger log.Logger) *LogAppender {
+	return &LogAppender{logger: logger}
+}
+
+// Append logs every series and its samples of the given request.
+func (a *LogAppender) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	for _, ts := range req.Timeseries {
+		m := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+
+		level.Debug(a.logger).Log("msg", m, "tenant", tenancy.FromContext(ctx))
+
+		for _, s := range ts.Samples {
+			level.Debug(a.logger).Log("msg", fmt.Sprintf("  %f %d", s.Value, s.Timestamp))
+		}
+	}
+
+	return nil
+}
+
+// Querier returns an empty querier, as nothing is kept.
+func (a *LogAppender) Querier(context.Context, int64, int64) (storage.Querier, error) {
+	return storage.NoopQuerier(), nil
+}
+
+// DiscardAppender is an appender that drops everything it receives.
+type DiscardAppender struct{}
+
+// NewDiscardAppender creates a new appender that drops all received series.
+func NewDiscardAppender() *DiscardAppender {
+	return &DiscardAppender{}
+}
+
+// Append drops the given request.
+func (DiscardAppender) Append(context.Context, *prompb.WriteRequest) error {
+	return nil
+}
+
+// Querier returns an empty querier, as nothing is kept.
+func (DiscardAppender) Querier(context.Context, int64, int64) (storage.Querier, error) {
+	return storage.NoopQuerier(), nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/tenancy"
+)
+
+// MultiTSDB is an appender that keeps a separate Prometheus TSDB per tenant, each in its own subdirectory.
+// The tenant is taken from the context of each call.
+type MultiTSDB struct {
+	dir    string
+	logger log.Logger
+	reg    prometheus.Registerer
+	opts   *tsdb.Options
+
+	mtx     sync.RWMutex
+	tenants map[string]*TSDB
+}
+
+// NewMultiTSDB creates a new multi-tenant TSDB in the given directory and opens the databases of all existing tenants.
+func NewMultiTSDB(dir string, logger log.Logger, reg prometheus.Registerer, opts *tsdb.Options) (*MultiTSDB, error) {
+	m := &MultiTSDB{
+		dir:     dir,
+		logger:  logger,
+		reg:     reg,
+		opts:    opts,
+		tenants: map[string]*TSDB{},
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read dir %s", dir)
+	}
+
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+
+		if f.Name() == "wal" {
+			return nil, errors.Errorf("%s contains a single-tenant tsdb, move it into a tenant subdirectory", dir)
+		}
+
+		if err := tenancy.Validate(f.Name()); err != nil {
+			level.Warn(logger).Log("msg", "skipping directory that is not a tenant tsdb", "dir", f.Name(), "err", err)
+			continue
+		}
+
+		if _, err := m.open(f.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Append writes all samples of the given request into the database of the tenant in context.
+func (m *MultiTSDB) Append(ctx context.Context, req *prompb.WriteRequest) error {
+	db, err := m.getOrOpen(tenancy.FromContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	return db.Append(ctx, req)
+}
+
+// Querier returns a querier over the database of the tenant in context.
+// Tenants that have not written anything yet get an empty querier.
+func (m *MultiTSDB) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	m.mtx.RLock()
+	db, ok := m.tenants[tenancy.FromContext(ctx)]
+	m.mtx.RUnlock()
+
+	if !ok {
+		return storage.NoopQuerier(), nil
+	}
+
+	return db.Querier(ctx, mint, maxt)
+}
+
+// Close closes the databases of all tenants.
+func (m *MultiTSDB) Close() error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var firstErr error
+
+	for tenant, db := range m.tenants {
+		if err := db.Close(); err != nil {
+			level.Error(m.logger).Log("msg", "failed to close tsdb", "tenant", tenant, "err", err)
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func (m *MultiTSDB) getOrOpen(tenant string) (*TSDB, error) {
+	m.mtx.RLock()
+	db, ok := m.tenants[tenant]
+	m.mtx.RUnlock()
+
+	if ok {
+		return db, nil
+	}
+
+	return m.open(tenant)
+}
+
+func (m *MultiTSDB) open(tenant string) (*TSDB, error) {
+	if err := tenancy.Validate(tenant); err != nil {
+		return nil, err
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if db, ok := m.tenants[tenant]; ok {
+		return db, nil
+	}
+
+	level.Info(m.logger).Log("msg", "opening tsdb", "tenant", tenant)
+
+	db, err := NewTSDB(
+		filepath.Join(m.dir, tenant),
+		log.With(m.logger, "tenant", tenant),
+		prometheus.WrapRegistererWith(prometheus.Labels{"tenant": tenant}, m.reg),
+		m.opts,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open tsdb of tenant %s", tenant)
+	}
+
+	m.tenants[tenant] = db
+
+	return db, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+
+	"github.com/kakkoyun/observable-remote-write/internal/labelpb"
+)
+
+// TSDB is an appender that persists received samples into a local Prometheus TSDB.
+// Head block, write-ahead log, compaction and retention are all handled by the embedded database.
+type TSDB struct {
+	db *tsdb.DB
+}
+
+// NewTSDB opens (or creates) a Prometheus TSDB in the given directory.
+func NewTSDB(dir string, logger log.Logger, reg prometheus.Registerer, opts *tsdb.Options) (*TSDB, error) {
+	db, err := tsdb.Open(dir, log.With(logger, "component", "tsdb"), reg, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open tsdb in %s", dir)
+	}
+
+	return &TSDB{db: db}, nil
+}
+
+// Append writes the samples of the given request in a single transaction.
+// Samples the database rejects as out of order, duplicate or out of bounds are skipped and the others are persisted;
+// the error returned then names the number of skipped samples and wraps the first rejection.
+// If any other error occurs, none of the samples are persisted.
+func (t *TSDB) Append(_ context.Context, req *prompb.WriteRequest) error {
+	var (
+		app = t.db.Appender()
+
+		firstErr                                    error
+		numOutOfOrder, numDuplicate, numOutOfBounds int
+	)
+
+	for _, ts := range req.Timeseries {
+		lset := labelpb.ToLabels(ts.Labels)
+
+		for _, s := range ts.Samples {
+			_, err := app.Add(lset, s.Timestamp, s.Value)
+
+			switch errors.Cause(err) {
+			case nil:
+				continue
+			case storage.ErrOutOfOrderSample:
+				numOutOfOrder++
+			case storage.ErrDuplicateSampleForTimestamp:
+				numDuplicate++
+			case storage.ErrOutOfBounds:
+				numOutOfBounds++
+			default:
+				if rerr := app.Rollback(); rerr != nil {
+					return errors.Wrapf(rerr, "rollback after failing to append series %s", lset)
+				}
+
+				return errors.Wrapf(err, "append series %s", lset)
+			}
+
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "append series %s", lset)
+			}
+		}
+	}
+
+	if err := app.Commit(); err != nil {
+		return errors.Wrap(err, "commit")
+	}
+
+	if firstErr != nil {
+		return errors.Wrapf(firstErr, "skipped %d out of order, %d duplicate and %d out of bounds samples",
+			numOutOfOrder, numDuplicate, numOutOfBounds)
+	}
+
+	return nil
+}
+
+// Querier returns a querier over the persisted samples of the given time range.
+func (t *TSDB) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return t.db.Querier(ctx, mint, maxt)
+}
+
+// Close closes the underlying database.
+func (t *TSDB) Close() error {
+	return t.db.Close()
+}
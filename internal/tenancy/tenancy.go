@@ -0,0 +1,135 @@
+package tenancy
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultTenantHeader is the HTTP header the tenant is read from by default.
+	DefaultTenantHeader = "THANOS-TENANT"
+	// DefaultTenant is the tenant requests without a tenant header are attributed to by default.
+	DefaultTenant = "default-tenant"
+)
+
+type ctxKey int
+
+const tenantKey = ctxKey(0)
+
+// NewContext creates a context with the given tenant.
+func NewContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// FromContext returns the tenant from context.
+func FromContext(ctx context.Context) string {
+	tenant, ok := ctx.Value(tenantKey).(string)
+	if !ok {
+		return ""
+	}
+
+	return tenant
+}
+
+// maxTenantLength is the maximum length of a tenant.
+const maxTenantLength = 128
+
+// reserved are names of files and directories of a Prometheus TSDB, which tenants must not be named like,
+// as each tenant is stored in a subdirectory of the storage directory.
+var reserved = map[string]struct{}{
+	"wal":            {},
+	"chunks_head":    {},
+	"lock":           {},
+	"queries.active": {},
+}
+
+// Validate checks that the given tenant is safe to use, e.g. as a directory name or a label value.
+// Tenants consist of letters, digits, '_', '-' and '.', and must not be named like a file of a Prometheus TSDB.
+func Validate(tenant string) error {
+	switch {
+	case tenant == "":
+		return errors.New("empty tenant")
+	case len(tenant) > maxTenantLength:
+		return errors.Errorf("tenant %q is longer than %d characters", tenant, maxTenantLength)
+	case tenant == "." || tenant == "..":
+		return errors.Errorf("invalid tenant %q", tenant)
+	case strings.IndexFunc(tenant, func(r rune) bool { return !validRune(r) }) >= 0:
+		return errors.Errorf("tenant %q must only contain letters, digits, '_', '-' and '.'", tenant)
+	}
+
+	if _, ok := reserved[tenant]; ok {
+		return errors.Errorf("tenant %q is reserved", tenant)
+	}
+
+	// TSDB blocks are directories named by their ULID.
+	if _, err := ulid.ParseStrict(tenant); err == nil {
+		return errors.Errorf("tenant %q is reserved, as it is a ULID", tenant)
+	}
+
+	return nil
+}
+
+func validRune(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == '-' || r == '.'
+}
+
+// Admitter decides which tenants requests are accepted from, to bound the number of tenants
+// a client can make the server keep state for, like databases or metric label values.
+type Admitter struct {
+	allowed map[string]struct{}
+	max     int
+
+	mtx  sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewAdmitter creates a new admitter of the given tenants, or of any tenants if none are given,
+// up to the given number of distinct tenants. No limit applies if max is 0.
+func NewAdmitter(allowed []string, max int) *Admitter {
+	a := &Admitter{
+		max:  max,
+		seen: map[string]struct{}{},
+	}
+
+	if len(allowed) > 0 {
+		a.allowed = make(map[string]struct{}, len(allowed))
+		for _, t := range allowed {
+			a.allowed[t] = struct{}{}
+		}
+	}
+
+	return a
+}
+
+// Admit returns an error if requests of the given tenant are not accepted.
+// Tenants are admitted for good once the first request of theirs was.
+func (a *Admitter) Admit(tenant string) error {
+	if a.allowed != nil {
+		if _, ok := a.allowed[tenant]; !ok {
+			return errors.Errorf("tenant %q is not allowed", tenant)
+		}
+	}
+
+	if a.max == 0 {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if _, ok := a.seen[tenant]; ok {
+		return nil
+	}
+
+	if len(a.seen) >= a.max {
+		return errors.Errorf("tenant %q exceeds the limit of %d tenants", tenant, a.max)
+	}
+
+	a.seen[tenant] = struct{}{}
+
+	return nil
+}